@@ -2,9 +2,26 @@ package cache
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/dmgk/fallout/pattern"
 )
 
+// newEntryInfo returns entry attributes, origin may have the @flavor suffix.
+func newEntryInfo(builder, origin string, timestamp time.Time) EntryInfo {
+	_, flavor, _ := strings.Cut(origin, pattern.FlavorSeparator)
+	return EntryInfo{
+		Builder:   builder,
+		Origin:    origin,
+		Flavor:    flavor,
+		Timestamp: timestamp,
+	}
+}
+
 // Cacher is the cache interface.
 type Cacher interface {
 	// Path returns this cache path (implementation-specific).
@@ -13,10 +30,24 @@ type Cacher interface {
 	Timestamp() time.Time
 	// Cache returns (a possibly not yet existing or empty) cache entry with given attributes.
 	Entry(builder, origin string, timestamp time.Time) (Entry, error)
+	// Lookup returns cache entry at path, as returned by Entry.Path.
+	Lookup(path string) (Entry, error)
 	// Walker returns cache walking interface.
 	Walker(filter *Filter) Walker
-	// Remove completely removes all cached data.
+	// Trash returns removed entries storage.
+	Trash() Trash
+	// Remove completely removes all cached data, including the trash.
 	Remove() error
+	// Prune frees storage no longer referenced by any entry, removes empty
+	// directories and returns the number of bytes freed.
+	Prune() (int64, error)
+	// Check verifies cache integrity and calls cfn for each found problem.
+	Check(cfn CheckFunc) error
+	// Pin pins entries, or unpins them if pin is false, like Entry.Pin and Entry.Unpin
+	// but saving pins only once.
+	Pin(entries []Entry, pin bool) error
+	// Touch marks entries as recently used, like Entry.Touch but recording them at once.
+	Touch(entries []Entry) error
 }
 
 // Entry is the cache entry interface.
@@ -27,15 +58,28 @@ type Entry interface {
 	Exists() bool
 	// Get returns entry contents.
 	Read() ([]byte, error)
+	// Open returns entry contents reader, for reading contents without loading them all at once.
+	Open() (io.ReadCloser, error)
 	// Put saves buf as the entry contents in the cache.
 	Write(buf []byte) error
 	// Remove removes this entry from the cache.
 	Remove() error
 	// With calls wfn with this entry contents as a byte slice.
-	// Underlying buffer is taken from the buffer pool and reused.
+	// Underlying buffer is either memory-mapped or taken from the buffer pool and reused,
+	// so it must not be retained or modified after wfn returns.
 	With(wfn WithFunc) error
 	// Info return entry attributes.
 	Info() EntryInfo
+	// Stat returns entry storage attributes.
+	Stat() (EntryStat, error)
+	// Touch marks entry as recently used.
+	Touch() error
+	// Pin protects entry from cleaning.
+	Pin() error
+	// Unpin removes entry protection from cleaning.
+	Unpin() error
+	// Pinned returns true if entry is protected from cleaning.
+	Pinned() bool
 	// String returns entry string representation.
 	String() string
 }
@@ -46,19 +90,35 @@ type WithFunc func(buf []byte) error
 type EntryInfo struct {
 	// Builder name.
 	Builder string
-	// Port origin.
+	// Port origin, category/name with an optional @flavor suffix.
 	Origin string
+	// Port flavor, empty if the port isn't flavored.
+	Flavor string
 	// Fallout log timestamp.
 	Timestamp time.Time
 }
 
+// EntryStat holds entry storage attributes.
+type EntryStat struct {
+	// Entry contents size.
+	Size int64
+	// ContentID identifies stored contents, entries with identical contents share the same ContentID.
+	ContentID string
+	// Number of entries sharing these contents, including this one.
+	Refs int
+	// Last time the entry was written or marked as used.
+	Used time.Time
+}
+
 // Filter describes what walked is allowed to walk.
 type Filter struct {
 	// Allowed builder names, partial names are ok.
+	// Values prefixed with "!" are excluded, globs and "~regexp" are also supported,
+	// see package pattern. This applies to all the lists below.
 	Builders []string
 	// Allowed categories, partial names are ok.
 	Categories []string
-	// Allowed origins, partial names are ok.
+	// Allowed origins, only full origins are ok. Origins without @flavor allow all port flavors.
 	Origins []string
 	// Allowed port names, partial names are ok.
 	Names []string
@@ -66,6 +126,118 @@ type Filter struct {
 	Since time.Time
 	// Allow logs only before this timestamp.
 	Before time.Time
+	// Order in which entries are walked.
+	Order Order
+	// Walk only the latest entries.
+	Latest Latest
+}
+
+// Latest selects which entries are considered the latest.
+type Latest int
+
+const (
+	// Walk all entries.
+	LatestNone Latest = iota
+	// Walk only the newest entry for each builder and origin.
+	LatestPerBuilder
+	// Walk only the newest entry for each origin across all builders.
+	LatestPerOrigin
+)
+
+// Order is the cache walk order.
+type Order int
+
+const (
+	// By builder, category, port name and timestamp, this is the cache directory order.
+	OrderBuilder Order = iota
+	// By origin across all builders, then by builder and timestamp.
+	OrderOrigin
+	// Newest entries first, across all builders.
+	OrderNewest
+	// Oldest entries first, across all builders.
+	OrderOldest
+)
+
+var orderNames = []string{
+	OrderBuilder: "builder",
+	OrderOrigin:  "origin",
+	OrderNewest:  "newest",
+	OrderOldest:  "oldest",
+}
+
+// OrderNames returns known walk order names.
+func OrderNames() []string {
+	return append([]string(nil), orderNames...)
+}
+
+// ParseOrder returns walk order with the given name.
+func ParseOrder(name string) (Order, error) {
+	for i, n := range orderNames {
+		if n == name {
+			return Order(i), nil
+		}
+	}
+	return OrderBuilder, fmt.Errorf("unknown order: %s", name)
+}
+
+func (o Order) String() string {
+	if int(o) < len(orderNames) {
+		return orderNames[o]
+	}
+	return fmt.Sprintf("order %d", o)
+}
+
+// filterMatcher is the compiled Filter.
+type filterMatcher struct {
+	builders   *pattern.List
+	categories *pattern.List
+	origins    *pattern.List
+	names      *pattern.List
+	since      time.Time
+	before     time.Time
+}
+
+// compile returns compiled filter, see package pattern for the terms syntax.
+func (f *Filter) compile() (*filterMatcher, error) {
+	m := &filterMatcher{
+		since:  f.Since,
+		before: f.Before,
+	}
+	var err error
+	if m.builders, err = pattern.Compile(f.Builders, pattern.Partial); err != nil {
+		return nil, err
+	}
+	if m.categories, err = pattern.Compile(f.Categories, pattern.Partial); err != nil {
+		return nil, err
+	}
+	if m.origins, err = pattern.Compile(f.Origins, pattern.Flavored); err != nil {
+		return nil, err
+	}
+	if m.names, err = pattern.Compile(f.Names, pattern.Partial); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *filterMatcher) builderAllowed(builder string) bool {
+	return m.builders.Match(builder)
+}
+
+func (m *filterMatcher) categoryAllowed(category string) bool {
+	return m.categories.Match(category)
+}
+
+func (m *filterMatcher) originAllowed(origin string) bool {
+	return m.origins.Match(origin)
+}
+
+// nameAllowed checks port name, flavors are ignored.
+func (m *filterMatcher) nameAllowed(name string) bool {
+	return m.names.Match(pattern.StripFlavor(name))
+}
+
+func (m *filterMatcher) timestampAllowed(ts time.Time) bool {
+	return !ts.Before(m.since) && (m.before.IsZero() || !ts.After(m.before))
 }
 
 // Walker is the cache walker interface.
@@ -76,6 +248,99 @@ type Walker interface {
 
 type WalkFunc func(entry Entry, err error) error
 
+// latestEntries returns only the newest entries for each origin across all builders,
+// preserving entries order.
+func latestEntries(entries []Entry) []Entry {
+	newest := map[string]time.Time{}
+	for _, e := range entries {
+		inf := e.Info()
+		if ts, ok := newest[inf.Origin]; !ok || inf.Timestamp.After(ts) {
+			newest[inf.Origin] = inf.Timestamp
+		}
+	}
+
+	var res []Entry
+	for _, e := range entries {
+		inf := e.Info()
+		if inf.Timestamp.Equal(newest[inf.Origin]) {
+			res = append(res, e)
+			delete(newest, inf.Origin) // walk only one of the same age entries
+		}
+	}
+	return res
+}
+
+// walkSorted sorts entries in the given order and calls wfn for each of them.
+func walkSorted(entries []Entry, order Order, wfn WalkFunc) error {
+	infos := make([]EntryInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = e.Info()
+	}
+	sort.Stable(&entrySorter{entries, infos, order})
+
+	for _, e := range entries {
+		if werr := wfn(e, nil); werr != nil {
+			if werr == Stop {
+				return nil
+			}
+			return werr
+		}
+	}
+	return nil
+}
+
+// entrySorter sorts entries in the given order.
+type entrySorter struct {
+	entries []Entry
+	infos   []EntryInfo
+	order   Order
+}
+
+func (s *entrySorter) Len() int {
+	return len(s.entries)
+}
+
+func (s *entrySorter) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.infos[i], s.infos[j] = s.infos[j], s.infos[i]
+}
+
+func (s *entrySorter) Less(i, j int) bool {
+	a, b := &s.infos[i], &s.infos[j]
+	switch s.order {
+	case OrderOrigin:
+		if a.Origin != b.Origin {
+			return originLess(a.Origin, b.Origin)
+		}
+		if a.Builder != b.Builder {
+			return a.Builder < b.Builder
+		}
+		return a.Timestamp.Before(b.Timestamp)
+	case OrderNewest:
+		return a.Timestamp.After(b.Timestamp)
+	case OrderOldest:
+		return a.Timestamp.Before(b.Timestamp)
+	default:
+		if a.Builder != b.Builder {
+			return a.Builder < b.Builder
+		}
+		if a.Origin != b.Origin {
+			return originLess(a.Origin, b.Origin)
+		}
+		return a.Timestamp.Before(b.Timestamp)
+	}
+}
+
+// originLess orders origins by category and then by port name.
+func originLess(a, b string) bool {
+	ac, an, _ := strings.Cut(a, "/")
+	bc, bn, _ := strings.Cut(b, "/")
+	if ac != bc {
+		return ac < bc
+	}
+	return an < bn
+}
+
 // Stop is a special value that can be returned by WalkFunc to indicate that
 // walking needs to be terminated early.
 var Stop = errors.New("stop")
@@ -0,0 +1,321 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ProblemKind describes the kind of cache integrity problem.
+type ProblemKind int
+
+const (
+	// Entry file name is not a valid timestamp or file is misplaced.
+	BadName ProblemKind = iota
+	// Entry has zero length.
+	EmptyEntry
+	// Stored contents don't match their hash, entry was truncated or corrupted.
+	CorruptEntry
+	// Directory has no entries.
+	EmptyDir
+	// Stray temporary file, left over from an interrupted write.
+	TempFile
+	// Cache timestamp disagrees with the newest entry timestamp.
+	BadTimestamp
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case BadName:
+		return "bad name"
+	case EmptyEntry:
+		return "empty entry"
+	case CorruptEntry:
+		return "corrupt entry"
+	case EmptyDir:
+		return "empty directory"
+	case TempFile:
+		return "temporary file"
+	case BadTimestamp:
+		return "bad timestamp"
+	default:
+		return fmt.Sprintf("problem %d", k)
+	}
+}
+
+// Problem describes one cache integrity problem.
+type Problem struct {
+	Kind ProblemKind
+	// Path of the problematic file or directory.
+	Path string
+	// Problem details, if any.
+	Detail string
+	// repair fixes the problem
+	repair func() error
+}
+
+// Repair fixes the problem, usually by removing the problematic data.
+// Removed entries will be downloaded again by the next fetch.
+func (p *Problem) Repair() error {
+	return p.repair()
+}
+
+func (p *Problem) String() string {
+	if p.Detail != "" {
+		return fmt.Sprintf("%s: %s: %s", p.Path, p.Kind, p.Detail)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Kind)
+}
+
+type CheckFunc func(p *Problem) error
+
+// Check verifies cache integrity and calls cfn for each found problem.
+// cfn may call Problem.Repair to fix it.
+func (c *Directory) Check(cfn CheckFunc) error {
+	ck := &checker{
+		cache:   c,
+		cfn:     cfn,
+		corrupt: map[string]bool{},
+	}
+	err := ck.checkObjects()
+	if err == nil {
+		err = ck.checkDir("", levelRoot)
+	}
+	if err == nil {
+		err = ck.checkTimestamp()
+	}
+	if err == Stop {
+		return nil
+	}
+	return err
+}
+
+// checker holds Directory check state.
+type checker struct {
+	cache *Directory
+	cfn   CheckFunc
+	// newest entry timestamp
+	newest time.Time
+	// content IDs of corrupt objects
+	corrupt map[string]bool
+}
+
+// Directory levels.
+const (
+	levelRoot = iota
+	levelBuilder
+	levelCategory
+	levelOrigin
+)
+
+func (ck *checker) report(kind ProblemKind, path, detail string, repair func() error) error {
+	return ck.cfn(&Problem{
+		Kind:   kind,
+		Path:   path,
+		Detail: detail,
+		repair: repair,
+	})
+}
+
+func removeFunc(path string) func() error {
+	return func() error {
+		return os.RemoveAll(path)
+	}
+}
+
+// checkDir checks directory at rel path, relative to the cache root.
+func (ck *checker) checkDir(rel string, level int) error {
+	path := filepath.Join(ck.cache.path, rel)
+	dir, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dir {
+		p := filepath.Join(path, d.Name())
+		switch {
+		case isTemp(d.Name()):
+			err = ck.report(TempFile, p, "", removeFunc(p))
+		case level == levelRoot && isHidden(d.Name()):
+			continue // service files
+		case level < levelOrigin && d.IsDir():
+			err = ck.checkDir(filepath.Join(rel, d.Name()), level+1)
+		case level < levelOrigin:
+			err = ck.report(BadName, p, "unexpected file", removeFunc(p))
+		case d.IsDir():
+			err = ck.report(BadName, p, "unexpected directory", removeFunc(p))
+		default:
+			err = ck.checkEntry(p, d.Name())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if level > levelRoot {
+		// re-read, repairs may have emptied the directory
+		if dir, err = os.ReadDir(path); err != nil {
+			return err
+		}
+		if len(dir) == 0 {
+			return ck.report(EmptyDir, path, "", func() error {
+				return os.Remove(path)
+			})
+		}
+	}
+
+	return nil
+}
+
+// checkEntry checks entry file at path.
+func (ck *checker) checkEntry(path, name string) error {
+	ts, err := time.Parse(timestampFormat, strings.TrimSuffix(name, ext))
+	if err != nil || !strings.HasSuffix(name, ext) {
+		return ck.report(BadName, path, "not a timestamp", removeFunc(path))
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return ck.report(EmptyEntry, path, "", removeFunc(path))
+	}
+	if ck.corrupt[fileContentID(fi, path)] {
+		return ck.report(CorruptEntry, path, "contents don't match stored hash", removeFunc(path))
+	}
+	if ts.After(ck.newest) {
+		ck.newest = ts
+	}
+	return nil
+}
+
+// checkObjects verifies that stored objects match their hashes.
+// It runs before entries are checked, so entries sharing corrupt contents can be found.
+func (ck *checker) checkObjects() error {
+	root := filepath.Join(ck.cache.path, objectsDirName)
+	dir, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, d := range dir {
+		path := filepath.Join(root, d.Name())
+		if isTemp(d.Name()) || !d.IsDir() {
+			if err := ck.report(TempFile, path, "", removeFunc(path)); err != nil {
+				return err
+			}
+			continue
+		}
+		objs, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, o := range objs {
+			if err := ck.checkObject(filepath.Join(path, o.Name()), o.Name()); err != nil {
+				return err
+			}
+		}
+		if objs, err = os.ReadDir(path); err != nil {
+			return err
+		}
+		if len(objs) == 0 {
+			if err := ck.report(EmptyDir, path, "", func() error { return os.Remove(path) }); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkObject verifies object at path.
+func (ck *checker) checkObject(path, name string) error {
+	if isTemp(name) {
+		return ck.report(TempFile, path, "", removeFunc(path))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) == name {
+		return nil
+	}
+
+	// entries linked to this object are reported by checkEntry
+	ck.corrupt[fileContentID(fi, path)] = true
+	return ck.report(CorruptEntry, path, "contents don't match stored hash", removeFunc(path))
+}
+
+// checkTimestamp verifies that cache timestamp isn't older than the newest entry.
+// It's newer after the newest entries were cleaned, fetch uses it to skip them.
+func (ck *checker) checkTimestamp() error {
+	c := ck.cache
+	path := filepath.Join(c.path, cacheTimestampName)
+	ts := loadTimestamp(c.path)
+	if !ts.Before(ck.newest) {
+		return nil
+	}
+
+	var detail string
+	if ts.IsZero() {
+		detail = fmt.Sprintf("missing or invalid, newest entry is %s", ck.newest.Format(cacheTimestampFormat))
+	} else {
+		detail = fmt.Sprintf("%s, newest entry is %s", ts.Format(cacheTimestampFormat), ck.newest.Format(cacheTimestampFormat))
+	}
+
+	return ck.report(BadTimestamp, path, detail, func() error {
+		c.timestamp = ck.newest
+		return os.WriteFile(path, []byte(ck.newest.Format(cacheTimestampFormat)), 0664)
+	})
+}
+
+// Check reports empty entries, in-memory cache can't have other problems.
+func (c *Memory) Check(cfn CheckFunc) error {
+	c.mu.RLock()
+	var empty []string
+	for p, obj := range c.entries {
+		if len(obj.buf) == 0 {
+			empty = append(empty, p)
+		}
+	}
+	c.mu.RUnlock()
+
+	for _, p := range empty {
+		p := p
+		err := cfn(&Problem{
+			Kind: EmptyEntry,
+			Path: memoryPath + p,
+			repair: func() error {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				c.unref(p)
+				return nil
+			},
+		})
+		if err != nil {
+			if err == Stop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -17,6 +17,16 @@ type Directory struct {
 	path string
 	// timestamp of the most recent entry
 	timestamp time.Time
+
+	pinsMu sync.Mutex // protects pins
+	// pinned entry paths, relative to the cache path, loaded lazily
+	pins map[string]bool
+
+	usedMu sync.Mutex // protects used
+	// entry last use times by entry path, relative to the cache path, loaded lazily
+	used map[string]time.Time
+	// number of lines in the used file
+	usedLines int
 }
 
 func NewDirectory(root, subdir string) (Cacher, error) {
@@ -27,6 +37,9 @@ func NewDirectory(root, subdir string) (Cacher, error) {
 	if err = os.MkdirAll(path, 0755); err != nil {
 		return nil, err
 	}
+	if err = checkLayout(path); err != nil {
+		return nil, err
+	}
 	return &Directory{
 		path:      path,
 		timestamp: loadTimestamp(path),
@@ -98,20 +111,30 @@ func (e *DirectoryEntry) Exists() bool {
 }
 
 func (e *DirectoryEntry) Read() ([]byte, error) {
-	f, err := os.Open(e.path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
+	return os.ReadFile(e.path)
+}
 
-	return io.ReadAll(f)
+func (e *DirectoryEntry) Open() (io.ReadCloser, error) {
+	return os.Open(e.path)
 }
 
+// Write stores buf in the objects directory and links the entry to it,
+// so identical contents are stored only once.
 func (e *DirectoryEntry) Write(buf []byte) error {
 	if err := os.MkdirAll(filepath.Dir(e.path), 0755); err != nil {
 		return err
 	}
-	if err := os.WriteFile(e.path, buf, 0644); err != nil {
+	obj, err := e.cache.putObject(buf)
+	if err != nil {
+		return err
+	}
+	if err := linkObject(obj, e.path); err != nil {
+		// filesystem may not support hardlinks, store contents directly
+		if err := writeFileAtomic(e.path, buf); err != nil {
+			return err
+		}
+	}
+	if err := e.Touch(); err != nil {
 		return err
 	}
 	e.cache.updateTimestamp(e.timestamp)
@@ -122,6 +145,8 @@ func (e *DirectoryEntry) Remove() error {
 	return os.Remove(e.path)
 }
 
+// With calls wfn with this entry contents. Contents are memory-mapped where
+// supported, otherwise they're streamed from Open into a buffer taken from the buffer pool.
 func (e *DirectoryEntry) With(wfn WithFunc) error {
 	f, err := os.Open(e.path)
 	if err != nil {
@@ -133,13 +158,26 @@ func (e *DirectoryEntry) With(wfn WithFunc) error {
 	if err != nil {
 		return err
 	}
+	if buf, unmap, ok := mapFile(f, fi.Size()); ok {
+		defer unmap()
+		return wfn(buf)
+	}
+	return e.withCopy(fi.Size(), wfn)
+}
+
+// withCopy calls wfn with this entry contents of the given size, read into a pooled buffer.
+func (e *DirectoryEntry) withCopy(size int64, wfn WithFunc) error {
+	r, err := e.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
 	buf := bufGet()
 	defer bufPut(buf)
 
-	buf.Grow(int(fi.Size()) + bytes.MinRead)
-	_, err = buf.ReadFrom(f)
-	if err != nil {
+	buf.Grow(int(size) + bytes.MinRead)
+	if _, err := buf.ReadFrom(r); err != nil {
 		return err
 	}
 
@@ -147,11 +185,34 @@ func (e *DirectoryEntry) With(wfn WithFunc) error {
 }
 
 func (e *DirectoryEntry) Info() EntryInfo {
-	return EntryInfo{
-		Builder:   e.builder,
-		Origin:    e.origin,
-		Timestamp: e.timestamp,
+	return newEntryInfo(e.builder, e.origin, e.timestamp)
+}
+
+func (e *DirectoryEntry) Stat() (EntryStat, error) {
+	fi, err := os.Stat(e.path)
+	if err != nil {
+		return EntryStat{}, err
+	}
+	refs := 1
+	if n := fileLinks(fi); n > 1 {
+		refs = n - 1 // not counting the object itself
 	}
+	used, ok := e.cache.lastUsed(e.key())
+	if !ok {
+		// entry predates use recording, contents modification time is the best guess
+		used = fi.ModTime()
+	}
+	return EntryStat{
+		Size:      fi.Size(),
+		ContentID: fileContentID(fi, e.path),
+		Refs:      refs,
+		Used:      used,
+	}, nil
+}
+
+// Touch records now as the entry last use time.
+func (e *DirectoryEntry) Touch() error {
+	return e.cache.setUsed(time.Now(), e.key())
 }
 
 func (e *DirectoryEntry) String() string {
@@ -171,21 +232,42 @@ func (c *Directory) Walker(filter *Filter) Walker {
 // DirectoryWalker implements filesystem cache Walker.
 type DirectoryWalker struct {
 	filter Filter
+	match  *filterMatcher
 	cache  *Directory
 }
 
 func (w *DirectoryWalker) Walk(wfn WalkFunc) error {
-	rch := make(chan Entry)
-	ech := make(chan error)
+	m, err := w.filter.compile()
+	if err != nil {
+		return err
+	}
+	w.match = m
 
-	go w.walkCache(rch, ech)
+	dw := &directoryWalk{
+		rch:  make(chan Entry),
+		ech:  make(chan error),
+		done: make(chan struct{}),
+	}
+	// stops walkCache if wfn stops the walk early
+	defer close(dw.done)
+
+	go w.walkCache(dw)
+
+	// entries are collected and then sorted if walk order isn't the directory order,
+	// or filtered if only the latest entries across all builders are needed
+	collect := w.filter.Order != OrderBuilder || w.filter.Latest == LatestPerOrigin
+	var sorted []Entry
 
 	rok := true
 	for rok {
 		var r Entry
 		select {
-		case r, rok = <-rch:
+		case r, rok = <-dw.rch:
 			if rok {
+				if collect {
+					sorted = append(sorted, r)
+					continue
+				}
 				if werr := wfn(r, nil); werr != nil {
 					if werr == Stop {
 						return nil
@@ -193,7 +275,7 @@ func (w *DirectoryWalker) Walk(wfn WalkFunc) error {
 					return werr
 				}
 			}
-		case err, eok := <-ech:
+		case err, eok := <-dw.ech:
 			if eok {
 				if werr := wfn(nil, err); werr != nil {
 					if werr == Stop {
@@ -205,104 +287,136 @@ func (w *DirectoryWalker) Walk(wfn WalkFunc) error {
 		}
 	}
 
-	return nil
-}
-
-func (w *DirectoryWalker) builderAllowed(builder string) bool {
-	return valueAllowed(builder, w.filter.Builders, false)
-}
-
-func (w *DirectoryWalker) categoryAllowed(category string) bool {
-	return valueAllowed(category, w.filter.Categories, false)
-}
-
-func (w *DirectoryWalker) originAllowed(origin string) bool {
-	return valueAllowed(origin, w.filter.Origins, true)
-}
-
-func (w *DirectoryWalker) nameAllowed(name string) bool {
-	return valueAllowed(name, w.filter.Names, false)
-}
-
-func valueAllowed(value string, filter []string, exact bool) bool {
-	if len(filter) == 0 {
-		return true
+	if w.filter.Latest == LatestPerOrigin {
+		sorted = latestEntries(sorted)
 	}
-	for _, s := range filter {
-		if exact && value == s || !exact && strings.Contains(value, s) {
-			return true
-		}
-	}
-	return false
+	return walkSorted(sorted, w.filter.Order, wfn)
 }
 
-func (w *DirectoryWalker) walkCache(rch chan Entry, ech chan error) {
-	defer close(rch)
-	defer close(ech)
+func (w *DirectoryWalker) walkCache(dw *directoryWalk) {
+	defer close(dw.rch)
+	defer close(dw.ech)
 
 	dir, err := os.ReadDir(w.cache.path)
 	if err != nil {
-		ech <- err
+		dw.fail(err)
 		return
 	}
 	for _, d := range dir {
-		if d.IsDir() && w.builderAllowed(d.Name()) {
-			w.walkBuilder(d.Name(), rch, ech)
+		if d.IsDir() && !isHidden(d.Name()) && w.match.builderAllowed(d.Name()) {
+			if !w.walkBuilder(d.Name(), dw) {
+				return
+			}
 		}
 	}
 }
 
-func (w *DirectoryWalker) walkBuilder(builder string, rch chan Entry, ech chan error) {
+// walkBuilder walks builder entries, it returns false if the walk was stopped.
+func (w *DirectoryWalker) walkBuilder(builder string, dw *directoryWalk) bool {
 	dir, err := os.ReadDir(filepath.Join(w.cache.path, builder))
 	if err != nil {
-		ech <- err
-		return
+		return dw.fail(err)
 	}
 	for _, d := range dir {
-		if d.IsDir() && w.categoryAllowed(d.Name()) {
-			w.walkCategory(builder, d.Name(), rch, ech)
+		if d.IsDir() && w.match.categoryAllowed(d.Name()) {
+			if !w.walkCategory(builder, d.Name(), dw) {
+				return false
+			}
 		}
 	}
+	return true
 }
 
-func (w *DirectoryWalker) walkCategory(builder, category string, rch chan Entry, ech chan error) {
+// walkCategory walks category entries, it returns false if the walk was stopped.
+func (w *DirectoryWalker) walkCategory(builder, category string, dw *directoryWalk) bool {
 	dir, err := os.ReadDir(filepath.Join(w.cache.path, builder, category))
 	if err != nil {
-		ech <- err
-		return
+		return dw.fail(err)
 	}
 	for _, d := range dir {
 		origin := category + string(filepath.Separator) + d.Name()
-		if d.IsDir() && w.originAllowed(origin) && w.nameAllowed(d.Name()) {
-			w.walkOrigin(builder, origin, rch, ech)
+		if d.IsDir() && w.match.originAllowed(origin) && w.match.nameAllowed(d.Name()) {
+			if !w.walkOrigin(builder, origin, dw) {
+				return false
+			}
 		}
 	}
+	return true
 }
 
-func (w *DirectoryWalker) walkOrigin(builder, origin string, rch chan Entry, ech chan error) {
+// walkOrigin walks origin entries, it returns false if the walk was stopped.
+func (w *DirectoryWalker) walkOrigin(builder, origin string, dw *directoryWalk) bool {
 	dir, err := os.ReadDir(filepath.Join(w.cache.path, builder, origin))
 	if err != nil {
-		ech <- err
-		return
+		return dw.fail(err)
 	}
+	// entries are named by timestamp, so the latest is the last one allowed
+	var latest Entry
 	for _, d := range dir {
-		if !d.IsDir() {
+		if !d.IsDir() && !isTemp(d.Name()) {
 			ts, err := time.Parse(timestampFormat, strings.TrimSuffix(d.Name(), ext))
 			if err != nil {
-				ech <- err
+				if !dw.fail(err) {
+					return false
+				}
 				continue
 			}
-			if ts.Before(w.filter.Since) || !w.filter.Before.IsZero() && ts.After(w.filter.Before) {
+			if !w.match.timestampAllowed(ts) {
 				continue
 			}
 			e, err := newEntry(w.cache, builder, origin, ts)
 			if err != nil {
-				ech <- err
+				if !dw.fail(err) {
+					return false
+				}
+				continue
+			}
+			if w.filter.Latest != LatestNone {
+				latest = e
 				continue
 			}
-			rch <- e
+			if !dw.send(e) {
+				return false
+			}
 		}
 	}
+	if latest != nil {
+		return dw.send(latest)
+	}
+	return true
+}
+
+// directoryWalk holds DirectoryWalker walk channels.
+type directoryWalk struct {
+	rch chan Entry
+	ech chan error
+	// closed when the walk is stopped
+	done chan struct{}
+}
+
+// send sends e to the walk consumer, it returns false if the walk was stopped.
+func (dw *directoryWalk) send(e Entry) bool {
+	select {
+	case dw.rch <- e:
+		return true
+	case <-dw.done:
+		return false
+	}
+}
+
+// fail sends err to the walk consumer, it returns false if the walk was stopped.
+func (dw *directoryWalk) fail(err error) bool {
+	select {
+	case dw.ech <- err:
+		return true
+	case <-dw.done:
+		return false
+	}
+}
+
+// isHidden returns true if name is a cache service file or directory name.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
 }
 
 const (
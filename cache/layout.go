@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory cache layout versions:
+//
+//	1  builder/category/name/<timestamp>.log files and the .timestamp file
+//	2  entries are hardlinks to the content-addressed objects in .objects
+//
+// Layout version is kept in the version file in the cache root. Caches
+// created before versioning have no version file and use layout 1.
+const LayoutVersion = 2
+
+const versionFileName = ".version"
+
+// LayoutError is returned by NewDirectory if the cache layout isn't supported.
+type LayoutError struct {
+	// Cache path.
+	Path string
+	// Cache layout version.
+	Version int
+}
+
+func (e *LayoutError) Error() string {
+	if e.Version < LayoutVersion {
+		return fmt.Sprintf("%s: cache layout version %d is outdated, current version is %d", e.Path, e.Version, LayoutVersion)
+	}
+	return fmt.Sprintf("%s: cache layout version %d is not supported, latest supported version is %d", e.Path, e.Version, LayoutVersion)
+}
+
+// Outdated returns true if the cache can be upgraded with Migrate.
+func (e *LayoutError) Outdated() bool {
+	return e.Version < LayoutVersion
+}
+
+// migration upgrades cache layout from version from to from+1.
+type migration struct {
+	from        int
+	description string
+	migrate     func(c *Directory) error
+}
+
+var migrations = []migration{
+	{1, "store identical logs once in the objects directory", migrateObjects},
+}
+
+// MigrateFunc is called before each migration step.
+type MigrateFunc func(from, to int, description string)
+
+// Migrate upgrades cache at path to the current layout version in place,
+// calling mfn before each migration step. mfn may be nil.
+func Migrate(path string, mfn MigrateFunc) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	version, err := layoutVersion(path)
+	if err != nil {
+		return err
+	}
+	if version > LayoutVersion {
+		return &LayoutError{Path: path, Version: version}
+	}
+
+	c := &Directory{path: path}
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+		if mfn != nil {
+			mfn(m.from, m.from+1, m.description)
+		}
+		if err := m.migrate(c); err != nil {
+			return fmt.Errorf("migrating from version %d: %w", m.from, err)
+		}
+		// record progress, so an interrupted migration resumes from the failed step
+		if err := writeLayoutVersion(path, m.from+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLayout verifies that cache at path uses the current layout.
+// New caches get the current layout version.
+func checkLayout(path string) error {
+	version, err := layoutVersion(path)
+	if err != nil {
+		return err
+	}
+	if version != LayoutVersion {
+		return &LayoutError{Path: path, Version: version}
+	}
+	if _, err := os.Stat(filepath.Join(path, versionFileName)); os.IsNotExist(err) {
+		return writeLayoutVersion(path, LayoutVersion)
+	}
+	return nil
+}
+
+// layoutVersion returns layout version of the cache at path.
+func layoutVersion(path string) (int, error) {
+	buf, err := os.ReadFile(filepath.Join(path, versionFileName))
+	if err == nil {
+		v, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err != nil || v < 1 {
+			return 0, fmt.Errorf("%s: invalid cache layout version: %q", path, buf)
+		}
+		return v, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	// no version file, cache is either new or created before versioning
+	dir, err := os.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return LayoutVersion, nil
+		}
+		return 0, err
+	}
+	for _, d := range dir {
+		if !isTemp(d.Name()) {
+			return 1, nil
+		}
+	}
+	return LayoutVersion, nil
+}
+
+func writeLayoutVersion(path string, version int) error {
+	return writeFileAtomic(filepath.Join(path, versionFileName), []byte(strconv.Itoa(version)+"\n"))
+}
+
+// migrateObjects moves contents of entries that aren't hardlinked yet to the objects directory.
+func migrateObjects(c *Directory) error {
+	return walkEntryFiles(c.path, func(path string, fi fs.FileInfo) error {
+		if fileLinks(fi) != 1 {
+			return nil // already linked, or hardlinks are not supported
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		obj, err := c.putObject(buf)
+		if err != nil {
+			return err
+		}
+		if err := linkObject(obj, path); err != nil {
+			return nil // filesystem may not support hardlinks, keep contents in place
+		}
+		// linked entries share the object modification time, keep the entry last use time
+		rel, err := filepath.Rel(c.path, path)
+		if err != nil {
+			return err
+		}
+		return c.setUsed(fi.ModTime(), filepath.ToSlash(rel))
+	})
+}
+
+// walkEntryFiles calls fn for each entry file in the cache at root, files not named
+// <timestamp>.log are left alone.
+func walkEntryFiles(root string, fn func(path string, fi fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		depth := strings.Count(rel, string(filepath.Separator)) + 1
+		switch {
+		case path == root:
+			return nil
+		case depth == 1 && isHidden(d.Name()):
+			if d.IsDir() {
+				return filepath.SkipDir // service directories
+			}
+			return nil
+		case d.IsDir():
+			if depth > levelOrigin {
+				return filepath.SkipDir
+			}
+			return nil
+		case depth != levelOrigin+1 || !isEntryName(d.Name()):
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, fi)
+	})
+}
+
+// isEntryName returns true if name is an entry file name, <timestamp>.log.
+func isEntryName(name string) bool {
+	if !strings.HasSuffix(name, ext) {
+		return false
+	}
+	_, err := time.Parse(timestampFormat, strings.TrimSuffix(name, ext))
+	return err == nil
+}
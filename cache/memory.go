@@ -0,0 +1,383 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory implements in-memory Cacher.
+// Identical contents are stored only once.
+type Memory struct {
+	mu sync.RWMutex // protects entries, objects, trash, pins, used and timestamp
+	// entry contents by entry path
+	entries map[string]*memoryObject
+	// unique contents by content hash
+	objects map[string]*memoryObject
+	// trashed entries by run name
+	trash map[string]*Memory
+	// pinned entry paths
+	pins map[string]bool
+	// last time entries were written or marked as used by entry path
+	used map[string]time.Time
+	// timestamp of the most recent entry
+	timestamp time.Time
+	// cache holds trashed entries, their contents are owned by the cache they were trashed from
+	trashed bool
+}
+
+// memoryObject holds stored contents.
+type memoryObject struct {
+	// contents SHA-256 hash
+	id  string
+	buf []byte
+	// number of entries referencing this object
+	refs int
+}
+
+const memoryPath = "memory:"
+
+// NewMemory returns an empty in-memory Cacher.
+func NewMemory() Cacher {
+	return &Memory{
+		entries: map[string]*memoryObject{},
+		objects: map[string]*memoryObject{},
+		trash:   map[string]*Memory{},
+		pins:    map[string]bool{},
+		used:    map[string]time.Time{},
+	}
+}
+
+func (c *Memory) Path() string {
+	return memoryPath
+}
+
+func (c *Memory) Timestamp() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.timestamp
+}
+
+func (c *Memory) Entry(builder, origin string, timestamp time.Time) (Entry, error) {
+	return newMemoryEntry(c, builder, origin, timestamp)
+}
+
+func (c *Memory) Remove() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*memoryObject{}
+	c.objects = map[string]*memoryObject{}
+	c.trash = map[string]*Memory{}
+	c.pins = map[string]bool{}
+	c.used = map[string]time.Time{}
+	c.timestamp = time.Time{}
+	return nil
+}
+
+// Prune is a no-op, objects are freed as soon as the last referencing entry is removed.
+func (c *Memory) Prune() (int64, error) {
+	return 0, nil
+}
+
+// put stores buf as entry contents at path, reusing identical stored contents.
+func (c *Memory) put(path string, buf []byte) {
+	h := sha256.Sum256(buf)
+	id := hex.EncodeToString(h[:])
+	obj, ok := c.objects[id]
+	if !ok {
+		obj = &memoryObject{
+			id:  id,
+			buf: append([]byte(nil), buf...),
+		}
+		c.objects[id] = obj
+	}
+	obj.refs++
+	c.unref(path)
+	c.entries[path] = obj
+	c.used[path] = time.Now()
+}
+
+// unref drops entry at path, freeing its contents if they aren't referenced anymore.
+func (c *Memory) unref(path string) {
+	if obj, ok := c.entries[path]; ok {
+		delete(c.entries, path)
+		delete(c.used, path)
+		if obj.refs--; obj.refs == 0 {
+			delete(c.objects, obj.id)
+		}
+	}
+}
+
+// MemoryEntry implements in-memory Entry.
+type MemoryEntry struct {
+	// memory cache that owns this entry
+	cache *Memory
+	// entry path, relative to the cache root
+	path      string
+	builder   string
+	origin    string
+	timestamp time.Time
+}
+
+func newMemoryEntry(c *Memory, builder, origin string, timestamp time.Time) (*MemoryEntry, error) {
+	if builder == "" {
+		return nil, errors.New("empty builder")
+	}
+	if origin == "" {
+		return nil, errors.New("empty origin")
+	}
+	if timestamp.IsZero() {
+		return nil, errors.New("zero timestamp")
+	}
+	return &MemoryEntry{
+		cache:     c,
+		path:      path.Join(builder, origin, timestamp.UTC().Format(timestampFormat)) + ext,
+		builder:   builder,
+		origin:    origin,
+		timestamp: timestamp.UTC(),
+	}, nil
+}
+
+func (e *MemoryEntry) Path() string {
+	return memoryPath + e.path
+}
+
+func (e *MemoryEntry) Exists() bool {
+	e.cache.mu.RLock()
+	defer e.cache.mu.RUnlock()
+	obj, ok := e.cache.entries[e.path]
+	return ok && len(obj.buf) > 0
+}
+
+func (e *MemoryEntry) Read() ([]byte, error) {
+	e.cache.mu.RLock()
+	defer e.cache.mu.RUnlock()
+	obj, ok := e.cache.entries[e.path]
+	if !ok {
+		return nil, e.notExist("read")
+	}
+	return append([]byte(nil), obj.buf...), nil
+}
+
+func (e *MemoryEntry) Write(buf []byte) error {
+	e.cache.mu.Lock()
+	defer e.cache.mu.Unlock()
+	e.cache.put(e.path, buf)
+	if e.timestamp.After(e.cache.timestamp) {
+		e.cache.timestamp = e.timestamp
+	}
+	return nil
+}
+
+func (e *MemoryEntry) Remove() error {
+	e.cache.mu.Lock()
+	defer e.cache.mu.Unlock()
+	if _, ok := e.cache.entries[e.path]; !ok {
+		return e.notExist("remove")
+	}
+	if e.cache.trashed {
+		// contents are released when the trash is emptied
+		return &fs.PathError{Op: "remove", Path: e.Path(), Err: errors.New("entry is in the trash")}
+	}
+	e.cache.unref(e.path)
+	return nil
+}
+
+// Open returns reader of this entry contents.
+func (e *MemoryEntry) Open() (io.ReadCloser, error) {
+	e.cache.mu.RLock()
+	obj, ok := e.cache.entries[e.path]
+	e.cache.mu.RUnlock()
+	if !ok {
+		return nil, e.notExist("open")
+	}
+	return io.NopCloser(bytes.NewReader(obj.buf)), nil
+}
+
+// With calls wfn with this entry contents.
+// Contents are stored immutably, so no copy is made.
+func (e *MemoryEntry) With(wfn WithFunc) error {
+	e.cache.mu.RLock()
+	obj, ok := e.cache.entries[e.path]
+	e.cache.mu.RUnlock()
+	if !ok {
+		return e.notExist("open")
+	}
+	return wfn(obj.buf)
+}
+
+func (e *MemoryEntry) Info() EntryInfo {
+	return newEntryInfo(e.builder, e.origin, e.timestamp)
+}
+
+func (e *MemoryEntry) Stat() (EntryStat, error) {
+	e.cache.mu.RLock()
+	defer e.cache.mu.RUnlock()
+	obj, ok := e.cache.entries[e.path]
+	if !ok {
+		return EntryStat{}, e.notExist("stat")
+	}
+	return EntryStat{
+		Size:      int64(len(obj.buf)),
+		ContentID: obj.id,
+		Refs:      obj.refs,
+		Used:      e.cache.used[e.path],
+	}, nil
+}
+
+func (c *Memory) Touch(entries []Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range entries {
+		e, ok := entry.(*MemoryEntry)
+		if !ok || e.cache != c {
+			return fmt.Errorf("%s: not a cache entry", entry)
+		}
+		if _, ok := c.entries[e.path]; !ok {
+			return e.notExist("touch")
+		}
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		c.used[entry.(*MemoryEntry).path] = now
+	}
+	return nil
+}
+
+func (e *MemoryEntry) Touch() error {
+	e.cache.mu.Lock()
+	defer e.cache.mu.Unlock()
+	if _, ok := e.cache.entries[e.path]; !ok {
+		return e.notExist("touch")
+	}
+	e.cache.used[e.path] = time.Now()
+	return nil
+}
+
+func (e *MemoryEntry) String() string {
+	return e.Path()
+}
+
+func (e *MemoryEntry) notExist(op string) error {
+	return &fs.PathError{Op: op, Path: e.Path(), Err: fs.ErrNotExist}
+}
+
+func (e *MemoryEntry) exist(op string) error {
+	return &fs.PathError{Op: op, Path: e.Path(), Err: fs.ErrExist}
+}
+
+func (c *Memory) Walker(filter *Filter) Walker {
+	w := &MemoryWalker{
+		cache: c,
+	}
+	if filter != nil {
+		w.filter = *filter
+	}
+	return w
+}
+
+// MemoryWalker implements in-memory cache Walker.
+// Entries are walked in the same order as DirectoryWalker walks them.
+type MemoryWalker struct {
+	filter Filter
+	cache  *Memory
+}
+
+func (w *MemoryWalker) Walk(wfn WalkFunc) error {
+	m, err := w.filter.compile()
+	if err != nil {
+		return err
+	}
+
+	entries := w.entries(m)
+	if w.filter.Latest == LatestPerBuilder {
+		// entries are sorted by builder, origin and timestamp, keep the last of each builder/origin run
+		var latest []*MemoryEntry
+		for i, e := range entries {
+			if i == len(entries)-1 || e.builder != entries[i+1].builder || e.origin != entries[i+1].origin {
+				latest = append(latest, e)
+			}
+		}
+		entries = latest
+	}
+
+	if w.filter.Order != OrderBuilder || w.filter.Latest == LatestPerOrigin {
+		sorted := make([]Entry, len(entries))
+		for i, e := range entries {
+			sorted[i] = e
+		}
+		if w.filter.Latest == LatestPerOrigin {
+			sorted = latestEntries(sorted)
+		}
+		return walkSorted(sorted, w.filter.Order, wfn)
+	}
+
+	for _, e := range entries {
+		if werr := wfn(e, nil); werr != nil {
+			if werr == Stop {
+				return nil
+			}
+			return werr
+		}
+	}
+	return nil
+}
+
+// entries returns a sorted snapshot of entries that made it through the filter.
+func (w *MemoryWalker) entries(m *filterMatcher) []*MemoryEntry {
+	w.cache.mu.RLock()
+	defer w.cache.mu.RUnlock()
+
+	var res []*MemoryEntry
+	for p := range w.cache.entries {
+		// path is builder/category/name/timestamp.log
+		dir, file := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+		builder, origin, _ := strings.Cut(dir, "/")
+		category, name, _ := strings.Cut(origin, "/")
+
+		if !(m.builderAllowed(builder) && m.categoryAllowed(category) &&
+			m.originAllowed(origin) && m.nameAllowed(name)) {
+			continue
+		}
+		ts, err := time.Parse(timestampFormat, strings.TrimSuffix(file, ext))
+		if err != nil || !m.timestampAllowed(ts) {
+			continue
+		}
+		res = append(res, &MemoryEntry{
+			cache:     w.cache,
+			path:      p,
+			builder:   builder,
+			origin:    origin,
+			timestamp: ts,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return memoryEntryLess(res[i], res[j])
+	})
+
+	return res
+}
+
+// memoryEntryLess orders entries by builder, category, port name and timestamp,
+// mirroring directory order.
+func memoryEntryLess(a, b *MemoryEntry) bool {
+	if a.builder != b.builder {
+		return a.builder < b.builder
+	}
+	if a.origin != b.origin {
+		return originLess(a.origin, b.origin)
+	}
+	return a.timestamp.Before(b.timestamp)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !freebsd
+
+package cache
+
+import (
+	"os"
+)
+
+// mapFile memory-maps the file f of the given size, ok is false if it can't be mapped.
+// Memory mapping isn't used on this platform.
+func mapFile(f *os.File, size int64) (buf []byte, unmap func(), ok bool) {
+	return nil, nil, false
+}
@@ -0,0 +1,22 @@
+//go:build linux || freebsd
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile memory-maps the file f of the given size, ok is false if it can't be mapped.
+// unmap has to be called once contents aren't needed anymore.
+func mapFile(f *os.File, size int64) (buf []byte, unmap func(), ok bool) {
+	if size == 0 || int64(int(size)) != size {
+		return nil, nil, false
+	}
+	buf, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		// filesystem may not support mmap
+		return nil, nil, false
+	}
+	return buf, func() { syscall.Munmap(buf) }, true
+}
@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Log bodies are stored once per unique content in the objects directory,
+// named by the content SHA-256 hash. Cache entries are hardlinks to objects.
+
+const (
+	objectsDirName = ".objects"
+	tempPrefix     = ".tmp-"
+)
+
+// objectPath returns path of the object holding content with the given hash.
+func (c *Directory) objectPath(sum string) string {
+	return filepath.Join(c.path, objectsDirName, sum[:2], sum)
+}
+
+// putObject stores buf in the objects directory, unless it's already there,
+// and returns the object path.
+func (c *Directory) putObject(buf []byte) (string, error) {
+	h := sha256.Sum256(buf)
+	path := c.objectPath(hex.EncodeToString(h[:]))
+
+	if fi, err := os.Stat(path); err == nil && fi.Size() == int64(len(buf)) {
+		return path, nil // already stored
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(path, buf); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// linkObject atomically replaces path with a hardlink to the object at objPath.
+func linkObject(objPath, path string) error {
+	tmp, err := tempName(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if err := os.Link(objPath, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes buf to a temporary file and then renames it to path.
+func writeFileAtomic(path string, buf []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// tempName returns an unused temporary file name in dir.
+func tempName(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	f.Close()
+	if err := os.Remove(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// isTemp returns true if name is a temporary file name.
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// Prune removes objects that are no longer referenced by any entry, last use records
+// of removed entries and empty builder, category and origin directories.
+// It returns the number of bytes freed.
+func (c *Directory) Prune() (int64, error) {
+	freed, err := c.pruneObjects()
+	if err != nil {
+		return freed, err
+	}
+	if err := c.compactUsed(); err != nil {
+		return freed, err
+	}
+	return freed, c.pruneDirs(c.path, levelRoot)
+}
+
+// pruneDirs removes empty directories under path, path is at the given level.
+func (c *Directory) pruneDirs(path string, level int) error {
+	dir, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	n := len(dir)
+	for _, d := range dir {
+		if !d.IsDir() || level == levelRoot && isHidden(d.Name()) || level == levelOrigin {
+			continue
+		}
+		p := filepath.Join(path, d.Name())
+		if err := c.pruneDirs(p, level+1); err != nil {
+			return err
+		}
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			n--
+		}
+	}
+	if n == 0 && level > levelRoot {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// pruneObjects removes objects that are no longer referenced by any entry
+// and object prefix directories left empty.
+func (c *Directory) pruneObjects() (int64, error) {
+	var freed int64
+	root := filepath.Join(c.path, objectsDirName)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == root {
+				return nil // nothing is stored yet
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// only the object itself links to its inode, the last referencing entry is gone
+		if fileLinks(fi) == 1 {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			freed += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return freed, err
+	}
+
+	// remove prefix directories left empty, removing non-empty ones just fails
+	dir, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return freed, nil
+		}
+		return freed, err
+	}
+	for _, d := range dir {
+		if d.IsDir() {
+			_ = os.Remove(filepath.Join(root, d.Name()))
+		}
+	}
+	return freed, nil
+}
@@ -0,0 +1,236 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pinned entries are protected from cleaning. Directory cache keeps pinned
+// entry paths, relative to the cache root, in the pins file.
+
+const pinsFileName = ".pins"
+
+// loadPins reads the pins file, unless it was already read.
+// c.pinsMu must be held.
+func (c *Directory) loadPins() error {
+	if c.pins != nil {
+		return nil
+	}
+	c.pins = map[string]bool{}
+	f, err := os.Open(filepath.Join(c.path, pinsFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if p := strings.TrimSpace(sc.Text()); p != "" {
+			c.pins[p] = true
+		}
+	}
+	return sc.Err()
+}
+
+// savePins writes the pins file, or removes it if nothing is pinned.
+// c.pinsMu must be held.
+func (c *Directory) savePins() error {
+	path := filepath.Join(c.path, pinsFileName)
+	if len(c.pins) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	keys := make([]string, 0, len(c.pins))
+	for p := range c.pins {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, p := range keys {
+		buf.WriteString(p)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// setPinned pins or unpins entries with the given keys.
+func (c *Directory) setPinned(pinned bool, keys ...string) error {
+	c.pinsMu.Lock()
+	defer c.pinsMu.Unlock()
+
+	if err := c.loadPins(); err != nil {
+		return err
+	}
+	var changed bool
+	for _, key := range keys {
+		if c.pins[key] == pinned {
+			continue
+		}
+		if pinned {
+			c.pins[key] = true
+		} else {
+			delete(c.pins, key)
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return c.savePins()
+}
+
+// pinned returns true if entry with the given key is pinned.
+func (c *Directory) pinned(key string) bool {
+	c.pinsMu.Lock()
+	defer c.pinsMu.Unlock()
+
+	if err := c.loadPins(); err != nil {
+		return false
+	}
+	return c.pins[key]
+}
+
+// key returns entry key in the pins and used files.
+func (e *DirectoryEntry) key() string {
+	rel, err := filepath.Rel(e.cache.path, e.path)
+	if err != nil {
+		return e.path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Pin protects entry from cleaning.
+func (e *DirectoryEntry) Pin() error {
+	if !e.Exists() {
+		return &os.PathError{Op: "pin", Path: e.path, Err: os.ErrNotExist}
+	}
+	return e.cache.setPinned(true, e.key())
+}
+
+// Unpin removes entry protection from cleaning.
+func (e *DirectoryEntry) Unpin() error {
+	return e.cache.setPinned(false, e.key())
+}
+
+// Pinned returns true if entry is protected from cleaning.
+func (e *DirectoryEntry) Pinned() bool {
+	return e.cache.pinned(e.key())
+}
+
+func (c *Directory) Pin(entries []Entry, pin bool) error {
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		e, ok := entry.(*DirectoryEntry)
+		if !ok || e.cache != c {
+			return fmt.Errorf("%s: not a cache entry", entry)
+		}
+		if pin && !e.Exists() {
+			return &os.PathError{Op: "pin", Path: e.path, Err: os.ErrNotExist}
+		}
+		keys = append(keys, e.key())
+	}
+	return c.setPinned(pin, keys...)
+}
+
+// Lookup returns entry at path, path is an absolute or relative to the cache root entry path.
+func (c *Directory) Lookup(path string) (Entry, error) {
+	rel := path
+	if filepath.IsAbs(path) {
+		var err error
+		if rel, err = filepath.Rel(c.path, path); err != nil {
+			return nil, err
+		}
+	}
+	builder, origin, ts, err := parseEntryPath(filepath.ToSlash(rel))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return newEntry(c, builder, origin, ts)
+}
+
+// Pin protects entry from cleaning.
+func (e *MemoryEntry) Pin() error {
+	e.cache.mu.Lock()
+	defer e.cache.mu.Unlock()
+	if _, ok := e.cache.entries[e.path]; !ok {
+		return e.notExist("pin")
+	}
+	e.cache.pins[e.path] = true
+	return nil
+}
+
+// Unpin removes entry protection from cleaning.
+func (e *MemoryEntry) Unpin() error {
+	e.cache.mu.Lock()
+	defer e.cache.mu.Unlock()
+	delete(e.cache.pins, e.path)
+	return nil
+}
+
+// Pinned returns true if entry is protected from cleaning.
+func (e *MemoryEntry) Pinned() bool {
+	e.cache.mu.RLock()
+	defer e.cache.mu.RUnlock()
+	return e.cache.pins[e.path]
+}
+
+func (c *Memory) Pin(entries []Entry, pin bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range entries {
+		e, ok := entry.(*MemoryEntry)
+		if !ok || e.cache != c {
+			return fmt.Errorf("%s: not a cache entry", entry)
+		}
+		if _, ok := c.entries[e.path]; pin && !ok {
+			return e.notExist("pin")
+		}
+	}
+	for _, entry := range entries {
+		path := entry.(*MemoryEntry).path
+		if pin {
+			c.pins[path] = true
+		} else {
+			delete(c.pins, path)
+		}
+	}
+	return nil
+}
+
+// Lookup returns entry at path, path is as returned by Entry.Path or relative to the cache root.
+func (c *Memory) Lookup(path string) (Entry, error) {
+	builder, origin, ts, err := parseEntryPath(strings.TrimPrefix(path, memoryPath))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return newMemoryEntry(c, builder, origin, ts)
+}
+
+// parseEntryPath parses slash-separated entry path builder/category/name/timestamp.log,
+// relative to the cache root.
+func parseEntryPath(path string) (string, string, time.Time, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 4 || !strings.HasSuffix(parts[3], ext) {
+		return "", "", time.Time{}, errors.New("not a cache entry path")
+	}
+	ts, err := time.Parse(timestampFormat, strings.TrimSuffix(parts[3], ext))
+	if err != nil {
+		return "", "", time.Time{}, errors.New("not a cache entry path")
+	}
+	return parts[0], parts[1] + "/" + parts[2], ts, nil
+}
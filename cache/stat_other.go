@@ -0,0 +1,17 @@
+//go:build !unix
+
+package cache
+
+import (
+	"os"
+)
+
+// fileContentID returns file contents identifier, hardlinks share the same identifier.
+func fileContentID(fi os.FileInfo, path string) string {
+	return path
+}
+
+// fileLinks returns the number of hardlinks to file, or -1 if it's unknown.
+func fileLinks(fi os.FileInfo) int {
+	return -1
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileContentID returns file contents identifier, hardlinks share the same identifier.
+func fileContentID(fi os.FileInfo, path string) string {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+	}
+	return path
+}
+
+// fileLinks returns the number of hardlinks to file, or -1 if it's unknown.
+func fileLinks(fi os.FileInfo) int {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Nlink)
+	}
+	return -1
+}
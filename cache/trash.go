@@ -0,0 +1,331 @@
+package cache
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Trash holds entries removed from the cache, grouped by the clean run that removed them.
+// Trashed entries keep their contents until the trash is emptied.
+type Trash interface {
+	// Runs returns times of the runs that have entries in the trash, oldest first.
+	Runs() ([]time.Time, error)
+	// Walker returns walker of the entries trashed by run, or by all runs if run is zero.
+	// Entries of different runs are walked run by run, oldest run first.
+	Walker(run time.Time, filter *Filter) Walker
+	// Put moves cache entry to the trash, under the given run.
+	Put(run time.Time, entry Entry) error
+	// Restore moves trashed entry back to the cache.
+	// It fails with fs.ErrExist if the cache already has the same entry.
+	Restore(entry Entry) error
+	// Empty permanently removes entries trashed by runs before the given time,
+	// or by all runs if before is zero.
+	Empty(before time.Time) error
+}
+
+const trashDirName = ".trash"
+
+// RunFormat is the trash run time format. Runs are named with sub-second precision
+// so that runs within the same second don't merge, names of runs without
+// fractional seconds are the same as entry timestamps.
+const RunFormat = "2006-01-02T15:04:05.999999999"
+
+// runName returns trash directory or key name for run.
+func runName(run time.Time) string {
+	return run.UTC().Format(RunFormat)
+}
+
+// runsWalker walks several trash runs in sequence.
+type runsWalker []Walker
+
+func (ws runsWalker) Walk(wfn WalkFunc) error {
+	var stopped bool
+	for _, w := range ws {
+		err := w.Walk(func(entry Entry, err error) error {
+			werr := wfn(entry, err)
+			if werr == Stop {
+				stopped = true
+			}
+			return werr
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// Trash returns directory cache trash. Trashed entries are stored in
+// .trash/<run>/ using the cache directory layout and keep sharing contents
+// with the cache entries until the trash is emptied.
+func (c *Directory) Trash() Trash {
+	return &directoryTrash{cache: c}
+}
+
+// directoryTrash implements filesystem Trash.
+type directoryTrash struct {
+	cache *Directory
+}
+
+func (t *directoryTrash) root() string {
+	return filepath.Join(t.cache.path, trashDirName)
+}
+
+// run returns cache holding entries trashed by run.
+func (t *directoryTrash) run(run time.Time) *Directory {
+	return &Directory{path: filepath.Join(t.root(), runName(run))}
+}
+
+func (t *directoryTrash) Runs() ([]time.Time, error) {
+	dir, err := os.ReadDir(t.root())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []time.Time
+	for _, d := range dir {
+		if !d.IsDir() {
+			continue
+		}
+		if run, err := time.Parse(RunFormat, d.Name()); err == nil {
+			res = append(res, run)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Before(res[j])
+	})
+	return res, nil
+}
+
+func (t *directoryTrash) Walker(run time.Time, filter *Filter) Walker {
+	if !run.IsZero() {
+		return t.run(run).Walker(filter)
+	}
+	runs, err := t.Runs()
+	if err != nil {
+		return errWalker{err}
+	}
+	var ws runsWalker
+	for _, r := range runs {
+		ws = append(ws, t.run(r).Walker(filter))
+	}
+	return ws
+}
+
+func (t *directoryTrash) Put(run time.Time, entry Entry) error {
+	e, ok := entry.(*DirectoryEntry)
+	if !ok || e.cache != t.cache {
+		return fmt.Errorf("%s: not a cache entry", entry)
+	}
+	rel, err := filepath.Rel(t.cache.path, e.path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(t.run(run).path, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(e.path, dst)
+}
+
+func (t *directoryTrash) Restore(entry Entry) error {
+	e, ok := entry.(*DirectoryEntry)
+	if !ok || filepath.Dir(e.cache.path) != t.root() {
+		return fmt.Errorf("%s: not a trashed entry", entry)
+	}
+	rel, err := filepath.Rel(e.cache.path, e.path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(t.cache.path, rel)
+	if _, err := os.Stat(dst); err == nil {
+		return &fs.PathError{Op: "restore", Path: dst, Err: fs.ErrExist}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(e.path, dst); err != nil {
+		return err
+	}
+	t.cache.updateTimestamp(e.timestamp)
+
+	// remove directories left empty, up to and including the run directory
+	for dir := filepath.Dir(e.path); dir != t.root(); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (t *directoryTrash) Empty(before time.Time) error {
+	runs, err := t.Runs()
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		if before.IsZero() || r.Before(before) {
+			if err := os.RemoveAll(t.run(r).path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// errWalker is a Walker that only reports an error.
+type errWalker struct {
+	err error
+}
+
+func (w errWalker) Walk(wfn WalkFunc) error {
+	if werr := wfn(nil, w.err); werr != nil && werr != Stop {
+		return werr
+	}
+	return nil
+}
+
+// Trash returns in-memory cache trash.
+func (c *Memory) Trash() Trash {
+	return &memoryTrash{cache: c}
+}
+
+// memoryTrash implements in-memory Trash.
+// Each run is a separate Memory holding trashed entries, which keep
+// referencing cache objects until the trash is emptied.
+type memoryTrash struct {
+	cache *Memory
+}
+
+func (t *memoryTrash) Runs() ([]time.Time, error) {
+	t.cache.mu.RLock()
+	defer t.cache.mu.RUnlock()
+
+	var res []time.Time
+	for name := range t.cache.trash {
+		if run, err := time.Parse(RunFormat, name); err == nil {
+			res = append(res, run)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Before(res[j])
+	})
+	return res, nil
+}
+
+func (t *memoryTrash) Walker(run time.Time, filter *Filter) Walker {
+	if !run.IsZero() {
+		t.cache.mu.RLock()
+		r, ok := t.cache.trash[runName(run)]
+		t.cache.mu.RUnlock()
+		if !ok {
+			r = NewMemory().(*Memory)
+		}
+		return r.Walker(filter)
+	}
+	runs, _ := t.Runs()
+	var ws runsWalker
+	for _, r := range runs {
+		ws = append(ws, t.Walker(r, filter))
+	}
+	return ws
+}
+
+func (t *memoryTrash) Put(run time.Time, entry Entry) error {
+	e, ok := entry.(*MemoryEntry)
+	if !ok || e.cache != t.cache {
+		return fmt.Errorf("%s: not a cache entry", entry)
+	}
+
+	c := t.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj, ok := c.entries[e.path]
+	if !ok {
+		return e.notExist("trash")
+	}
+	name := runName(run)
+	r, ok := c.trash[name]
+	if !ok {
+		r = NewMemory().(*Memory)
+		r.trashed = true
+		c.trash[name] = r
+	}
+	r.mu.Lock()
+	r.entries[e.path] = obj
+	r.used[e.path] = c.used[e.path]
+	r.mu.Unlock()
+	delete(c.entries, e.path)
+	delete(c.used, e.path)
+	return nil
+}
+
+func (t *memoryTrash) Restore(entry Entry) error {
+	e, ok := entry.(*MemoryEntry)
+	if !ok {
+		return fmt.Errorf("%s: not a trashed entry", entry)
+	}
+
+	c := t.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var name string
+	for n, r := range c.trash {
+		if r == e.cache {
+			name = n
+		}
+	}
+	if name == "" {
+		return fmt.Errorf("%s: not a trashed entry", entry)
+	}
+	if _, ok := c.entries[e.path]; ok {
+		return e.exist("restore")
+	}
+
+	r := e.cache
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	obj, ok := r.entries[e.path]
+	if !ok {
+		return e.notExist("restore")
+	}
+	c.entries[e.path] = obj
+	c.used[e.path] = r.used[e.path]
+	delete(r.entries, e.path)
+	delete(r.used, e.path)
+	if len(r.entries) == 0 {
+		delete(c.trash, name)
+	}
+	if e.timestamp.After(c.timestamp) {
+		c.timestamp = e.timestamp
+	}
+	return nil
+}
+
+func (t *memoryTrash) Empty(before time.Time) error {
+	c := t.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, r := range c.trash {
+		run, err := time.Parse(RunFormat, name)
+		if err != nil || !before.IsZero() && !run.Before(before) {
+			continue
+		}
+		for _, obj := range r.entries {
+			if obj.refs--; obj.refs == 0 {
+				delete(c.objects, obj.id)
+			}
+		}
+		delete(c.trash, name)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entries sharing contents share the object inode, so its modification time can't
+// tell when each of them was used. Directory cache records entry last use times
+// in the used file instead, one "<RFC-3339 time> <entry key>" line per use, with
+// entry keys as in the pins file. Lines are appended, so marking entries as used
+// is cheap, and the file is compacted by Prune or once it has too many outdated lines.
+
+const (
+	usedFileName = ".used"
+	// the used file is compacted when it has more than this many lines
+	// and most of them are outdated
+	usedCompactLines = 10000
+)
+
+// loadUsed reads the used file, unless it was already read.
+// c.usedMu must be held.
+func (c *Directory) loadUsed() error {
+	if c.used != nil {
+		return nil
+	}
+	c.used = map[string]time.Time{}
+	f, err := os.Open(filepath.Join(c.path, usedFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		ts, key, ok := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			continue
+		}
+		// later records win
+		c.used[key] = t
+		c.usedLines++
+	}
+	return sc.Err()
+}
+
+// setUsed records entries with the given keys as used at t, with a single append.
+func (c *Directory) setUsed(t time.Time, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	c.usedMu.Lock()
+	defer c.usedMu.Unlock()
+
+	if err := c.loadUsed(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	ts := t.UTC().Format(time.RFC3339)
+	for _, key := range keys {
+		c.used[key] = t
+		fmt.Fprintf(&buf, "%s %s\n", ts, key)
+	}
+	c.usedLines += len(keys)
+	if c.usedLines > usedCompactLines && c.usedLines > 2*len(c.used) {
+		return c.saveUsed()
+	}
+
+	f, err := os.OpenFile(filepath.Join(c.path, usedFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *Directory) Touch(entries []Entry) error {
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		e, ok := entry.(*DirectoryEntry)
+		if !ok || e.cache != c {
+			return fmt.Errorf("%s: not a cache entry", entry)
+		}
+		keys = append(keys, e.key())
+	}
+	return c.setUsed(time.Now(), keys...)
+}
+
+// lastUsed returns the last use time of entry with the given key, ok is false if it wasn't recorded.
+func (c *Directory) lastUsed(key string) (t time.Time, ok bool) {
+	c.usedMu.Lock()
+	defer c.usedMu.Unlock()
+
+	if err := c.loadUsed(); err != nil {
+		return t, false
+	}
+	t, ok = c.used[key]
+	return t, ok
+}
+
+// compactUsed rewrites the used file with only the latest records of existing entries,
+// or removes it if there are none.
+func (c *Directory) compactUsed() error {
+	c.usedMu.Lock()
+	defer c.usedMu.Unlock()
+
+	if err := c.loadUsed(); err != nil {
+		return err
+	}
+	return c.saveUsed()
+}
+
+// saveUsed writes the used file with only the latest records of existing entries,
+// or removes it if there are none. c.usedMu must be held.
+func (c *Directory) saveUsed() error {
+	keys := make([]string, 0, len(c.used))
+	for key := range c.used {
+		if _, err := os.Stat(filepath.Join(c.path, filepath.FromSlash(key))); err != nil {
+			delete(c.used, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	c.usedLines = len(keys)
+	path := filepath.Join(c.path, usedFileName)
+	if len(keys) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s %s\n", c.used[key].UTC().Format(time.RFC3339), key)
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var walkerTestEntries = []struct {
+	builder string
+	origin  string
+	day     int
+}{
+	{"main-amd64-default", "devel/foo", 1},
+	{"main-amd64-default", "devel/foo", 3},
+	{"main-amd64-default", "devel/foobar", 2},
+	{"main-amd64-default", "devel/py-bar@py39", 1},
+	{"main-amd64-default", "devel/py-bar@py310", 2},
+	{"main-i386-default", "devel/foo", 2},
+	{"main-i386-default", "www/foo", 3},
+	{"131amd64-quarterly", "devel/foobar", 1},
+	{"131amd64-quarterly", "www/foo", 2},
+}
+
+func walkerTestDay(day int) time.Time {
+	return time.Date(2022, 7, day, 0, 0, 0, 0, time.UTC)
+}
+
+// walkerTestName returns entry name as "builder origin day".
+func walkerTestName(entry Entry) string {
+	inf := entry.Info()
+	return fmt.Sprintf("%s %s %d", inf.Builder, inf.Origin, inf.Timestamp.Day())
+}
+
+// walkerTestCaches returns memory and directory caches holding walkerTestEntries.
+func walkerTestCaches(t *testing.T) map[string]Cacher {
+	dc, err := NewDirectory(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caches := map[string]Cacher{
+		"memory":    NewMemory(),
+		"directory": dc,
+	}
+	for name, c := range caches {
+		for i, te := range walkerTestEntries {
+			e, err := c.Entry(te.builder, te.origin, walkerTestDay(te.day))
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if err := e.Write([]byte(fmt.Sprintf("log %d\n", i))); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+		}
+	}
+	return caches
+}
+
+func TestWalkerFilter(t *testing.T) {
+	caches := walkerTestCaches(t)
+
+	tests := []struct {
+		name   string
+		filter *Filter
+		// expected entry names, sorted
+		want []string
+	}{
+		{
+			name:   "no filter",
+			filter: nil,
+			want: []string{
+				"131amd64-quarterly devel/foobar 1",
+				"131amd64-quarterly www/foo 2",
+				"main-amd64-default devel/foo 1",
+				"main-amd64-default devel/foo 3",
+				"main-amd64-default devel/foobar 2",
+				"main-amd64-default devel/py-bar@py310 2",
+				"main-amd64-default devel/py-bar@py39 1",
+				"main-i386-default devel/foo 2",
+				"main-i386-default www/foo 3",
+			},
+		},
+		{
+			name:   "partial builder",
+			filter: &Filter{Builders: []string{"i386"}},
+			want: []string{
+				"main-i386-default devel/foo 2",
+				"main-i386-default www/foo 3",
+			},
+		},
+		{
+			name:   "excluded builder",
+			filter: &Filter{Builders: []string{"main", "!i386"}},
+			want: []string{
+				"main-amd64-default devel/foo 1",
+				"main-amd64-default devel/foo 3",
+				"main-amd64-default devel/foobar 2",
+				"main-amd64-default devel/py-bar@py310 2",
+				"main-amd64-default devel/py-bar@py39 1",
+			},
+		},
+		{
+			name:   "builder regexp",
+			filter: &Filter{Builders: []string{"~^[0-9]+amd64"}},
+			want: []string{
+				"131amd64-quarterly devel/foobar 1",
+				"131amd64-quarterly www/foo 2",
+			},
+		},
+		{
+			name:   "partial category",
+			filter: &Filter{Categories: []string{"ww"}},
+			want: []string{
+				"131amd64-quarterly www/foo 2",
+				"main-i386-default www/foo 3",
+			},
+		},
+		{
+			name:   "exact origin",
+			filter: &Filter{Origins: []string{"devel/foo"}},
+			want: []string{
+				"main-amd64-default devel/foo 1",
+				"main-amd64-default devel/foo 3",
+				"main-i386-default devel/foo 2",
+			},
+		},
+		{
+			name:   "origin without flavor",
+			filter: &Filter{Origins: []string{"devel/py-bar"}},
+			want: []string{
+				"main-amd64-default devel/py-bar@py310 2",
+				"main-amd64-default devel/py-bar@py39 1",
+			},
+		},
+		{
+			name:   "flavored origin",
+			filter: &Filter{Origins: []string{"devel/py-bar@py39"}},
+			want: []string{
+				"main-amd64-default devel/py-bar@py39 1",
+			},
+		},
+		{
+			name:   "origin glob",
+			filter: &Filter{Origins: []string{"devel/foo*"}},
+			want: []string{
+				"131amd64-quarterly devel/foobar 1",
+				"main-amd64-default devel/foo 1",
+				"main-amd64-default devel/foo 3",
+				"main-amd64-default devel/foobar 2",
+				"main-i386-default devel/foo 2",
+			},
+		},
+		{
+			name:   "partial name ignores flavor",
+			filter: &Filter{Names: []string{"bar"}},
+			want: []string{
+				"131amd64-quarterly devel/foobar 1",
+				"main-amd64-default devel/foobar 2",
+				"main-amd64-default devel/py-bar@py310 2",
+				"main-amd64-default devel/py-bar@py39 1",
+			},
+		},
+		{
+			name:   "since and before",
+			filter: &Filter{Since: walkerTestDay(2), Before: walkerTestDay(2)},
+			want: []string{
+				"131amd64-quarterly www/foo 2",
+				"main-amd64-default devel/foobar 2",
+				"main-amd64-default devel/py-bar@py310 2",
+				"main-i386-default devel/foo 2",
+			},
+		},
+		{
+			name:   "latest per builder",
+			filter: &Filter{Origins: []string{"devel/foo"}, Latest: LatestPerBuilder},
+			want: []string{
+				"main-amd64-default devel/foo 3",
+				"main-i386-default devel/foo 2",
+			},
+		},
+		{
+			name:   "latest per origin",
+			filter: &Filter{Origins: []string{"devel/foo", "www/foo"}, Latest: LatestPerOrigin},
+			want: []string{
+				"main-amd64-default devel/foo 3",
+				"main-i386-default www/foo 3",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			walked := map[string][]string{}
+			for name, c := range caches {
+				var got []string
+				err := c.Walker(tt.filter).Walk(func(entry Entry, err error) error {
+					if err != nil {
+						return err
+					}
+					got = append(got, walkerTestName(entry))
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				walked[name] = got
+
+				sorted := append([]string(nil), got...)
+				sort.Strings(sorted)
+				if !reflect.DeepEqual(sorted, tt.want) {
+					t.Errorf("%s: got %q, want %q", name, sorted, tt.want)
+				}
+			}
+			// walk order is the same too
+			if !reflect.DeepEqual(walked["memory"], walked["directory"]) {
+				t.Errorf("memory walked %q, directory walked %q", walked["memory"], walked["directory"])
+			}
+		})
+	}
+}
+
+func TestWalkerOrder(t *testing.T) {
+	caches := walkerTestCaches(t)
+
+	for _, order := range []Order{OrderBuilder, OrderOrigin, OrderNewest, OrderOldest} {
+		t.Run(order.String(), func(t *testing.T) {
+			walked := map[string][]string{}
+			for name, c := range caches {
+				err := c.Walker(&Filter{Order: order}).Walk(func(entry Entry, err error) error {
+					if err != nil {
+						return err
+					}
+					walked[name] = append(walked[name], walkerTestName(entry))
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+			}
+			if len(walked["memory"]) != len(walkerTestEntries) {
+				t.Errorf("walked %d entries, want %d", len(walked["memory"]), len(walkerTestEntries))
+			}
+			if !reflect.DeepEqual(walked["memory"], walked["directory"]) {
+				t.Errorf("memory walked %q, directory walked %q", walked["memory"], walked["directory"])
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+
+	"github.com/dmgk/fallout/cache"
+	"github.com/dmgk/getopt"
+)
+
+var cacheUsageTmpl = template.Must(template.New("usage-cache").Parse(`
+usage: {{.progname}} cache [-h] command [options]
+
+Manage log cache.
+
+Options:
+  -h              show help and exit
+
+Commands (pass -h for command help):{{range .cmds}}
+  {{printf "%-15s" .Name}} {{.Summary}}{{end}}
+`[1:]))
+
+var cacheMigrateUsageTmpl = template.Must(template.New("usage-cache-migrate").Parse(`
+usage: {{.progname}} cache migrate [-h]
+
+Upgrade log cache to the current layout version {{.version}} in place.
+
+Options:
+  -h              show help and exit
+`[1:]))
+
+var cacheCmd = command{
+	Name:    "cache",
+	Summary: "manage log cache",
+	run:     runCache,
+}
+
+var cacheMigrateCmd = command{
+	Name:    "migrate",
+	Summary: "upgrade log cache layout",
+	run:     runCacheMigrate,
+}
+
+var cacheCmds = []*command{
+	&cacheMigrateCmd,
+}
+
+func showCacheUsage() {
+	err := cacheUsageTmpl.Execute(os.Stdout, map[string]any{
+		"progname": progname,
+		"cmds":     cacheCmds,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("error executing template %s: %v", cacheUsageTmpl.Name(), err))
+	}
+}
+
+func showCacheMigrateUsage() {
+	err := cacheMigrateUsageTmpl.Execute(os.Stdout, map[string]any{
+		"progname": progname,
+		"version":  cache.LayoutVersion,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("error executing template %s: %v", cacheMigrateUsageTmpl.Name(), err))
+	}
+}
+
+func runCache(args []string) int {
+	opts, err := getopt.NewArgv("h", args)
+	if err != nil {
+		panic(fmt.Sprintf("error creating options parser: %s", err))
+	}
+
+	for opts.Scan() {
+		opt, err := opts.Option()
+		if err != nil {
+			errExit(err.Error())
+		}
+
+		switch opt.Opt {
+		case 'h':
+			showCacheUsage()
+			os.Exit(0)
+		default:
+			panic("unhandled option: -" + string(opt.Opt))
+		}
+	}
+
+	args = opts.Args()
+	if len(args) == 0 {
+		showCacheUsage()
+		os.Exit(1)
+	}
+
+	for _, c := range cacheCmds {
+		if c.Name == args[0] {
+			return c.run(args)
+		}
+	}
+	showCacheUsage()
+	return 1
+}
+
+func runCacheMigrate(args []string) int {
+	opts, err := getopt.NewArgv("h", args)
+	if err != nil {
+		panic(fmt.Sprintf("error creating options parser: %s", err))
+	}
+
+	for opts.Scan() {
+		opt, err := opts.Option()
+		if err != nil {
+			errExit(err.Error())
+		}
+
+		switch opt.Opt {
+		case 'h':
+			showCacheMigrateUsage()
+			os.Exit(0)
+		default:
+			panic("unhandled option: -" + string(opt.Opt))
+		}
+	}
+
+	p, err := loadProfile()
+	if err != nil {
+		errExit("error loading profile: %s", err)
+	}
+	path, err := cachePath(p)
+	if err != nil {
+		errExit("error: %s", err)
+	}
+
+	var steps int
+	err = cache.Migrate(path, func(from, to int, description string) {
+		fmt.Printf("Migrating %s from version %d to %d: %s\n", path, from, to, description)
+		steps++
+	})
+	if err != nil {
+		errExit("error migrating cache: %s", err)
+	}
+	if steps == 0 {
+		fmt.Printf("Cache %s is up to date.\n", path)
+	}
+
+	return 0
+}
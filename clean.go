@@ -11,15 +11,28 @@ import (
 )
 
 var cleanUsageTmpl = template.Must(template.New("usage-clean").Parse(`
-usage: {{.progname}} clean [-hx] [-D days] [-A date]
+usage: {{.progname}} clean [-hxpEU] [-D days] [-A date] [-S size] [-k count] [-b builder[,builder]] [-c category[,category]] [-o origin[,origin]] [-n name[,name]]
 
-Clean log cache.
+Clean log cache. Removed logs are moved to the trash and kept there for {{.trashDays}} day(s),
+they can be brought back with "{{.progname}} restore". Logs pinned with "{{.progname}} pin" are never removed.
 
 Options:
-  -h          show help and exit
-  -x          remove all cached data
-  -D days     remove logs that are more than days old (default: {{.daysLimit}})
-  -A date     remove logs that are older than date, in RFC-3339 format (default: {{.dateLimit.Format .dateFormat}})
+  -h              show help and exit
+  -x              remove all logs selected by filters, without filters and with -E
+                  remove all cached data except pinned logs
+  -p              only show what would be removed, also --dry-run
+  -E              permanently remove logs in the trash, also --empty-trash
+  -D days         remove logs that are more than days old (default: {{.daysLimit}})
+  -A date         remove logs that are older than date, in RFC-3339 format (default: {{.dateLimit.Format .dateFormat}})
+  -S size         permanently remove the oldest logs until the cache fits in size, e.g. 500M or 2G
+  -U              with -S, remove the least recently used logs first, logs are used when grep matches them
+  -k count        always keep count latest logs for each builder and origin
+  -b builder,...  remove only logs from these builders
+  -c category,... remove only logs for these categories
+  -o origin,...   remove only logs for these origins, use origin@flavor for a single flavor
+  -n name,...     remove only logs for these port names
+                  values can be globs, e.g. -o 'devel/py-*', or regexps prefixed with ~, e.g. -b '~^main-.*-default$'
+                  prefix a value with ! to exclude it, e.g. -b '!i386'
 `[1:]))
 
 var cleanCmd = command{
@@ -33,14 +46,25 @@ const defaultCleanDaysLimit = 30
 var (
 	cleanDateLimit = time.Now().UTC().AddDate(0, 0, -defaultCleanDaysLimit)
 	cleanAll       bool
+	cleanDryRun    bool
+	cleanTrash     bool
+	cleanByDate          = true
+	cleanQuota     int64 = -1
+	cleanLRU       bool
+	cleanKeep      int
 )
 
 func showCleanUsage() {
+	trashDays := defaultTrashDays
+	if p, err := loadProfile(); err == nil {
+		trashDays = p.trashDays
+	}
 	err := cleanUsageTmpl.Execute(os.Stdout, map[string]any{
 		"progname":   progname,
 		"daysLimit":  defaultCleanDaysLimit,
 		"dateLimit":  cleanDateLimit,
 		"dateFormat": dateFormat,
+		"trashDays":  trashDays,
 	})
 	if err != nil {
 		panic(fmt.Sprintf("error executing template %s: %v", cleanUsageTmpl.Name(), err))
@@ -48,11 +72,16 @@ func showCleanUsage() {
 }
 
 func runClean(args []string) int {
-	opts, err := getopt.NewArgv("hxD:A:", args)
+	const optstring = "hxpEUD:A:S:k:b:c:o:n:"
+	opts, err := getopt.NewArgv(optstring, expandLongOptions(args, optstring, map[string]byte{
+		"dry-run":     'p',
+		"empty-trash": 'E',
+	}))
 	if err != nil {
 		panic(fmt.Sprintf("error creating options parser: %s", err))
 	}
 
+	var explicitDate bool
 	for opts.Scan() {
 		opt, err := opts.Option()
 		if err != nil {
@@ -65,29 +94,68 @@ func runClean(args []string) int {
 			os.Exit(0)
 		case 'x':
 			cleanAll = true
+		case 'p':
+			cleanDryRun = true
+		case 'E':
+			cleanTrash = true
 		case 'D':
 			v, err := opt.Int()
 			if err != nil {
 				errExit("-D: %s", err)
 			}
 			cleanDateLimit = time.Now().UTC().AddDate(0, 0, -v)
+			explicitDate = true
 		case 'A':
 			t, err := parseDateTime(opt.String())
 			if err != nil {
 				errExit("-A: %s", err)
 			}
 			cleanDateLimit = t
+			explicitDate = true
+		case 'S':
+			v, err := parseSize(opt.String())
+			if err != nil {
+				errExit("-S: %s", err)
+			}
+			cleanQuota = v
+		case 'U':
+			cleanLRU = true
+		case 'k':
+			v, err := opt.Int()
+			if err != nil {
+				errExit("-k: %s", err)
+			}
+			cleanKeep = v
+		case 'b':
+			builders = splitOptions(opt.String())
+		case 'c':
+			categories = splitOptions(opt.String())
+		case 'o':
+			origins = splitOptions(opt.String())
+		case 'n':
+			names = splitOptions(opt.String())
 		default:
 			panic("unhandled option: -" + string(opt.Opt))
 		}
 	}
 
-	c, err := cache.NewDefaultDirectory(progname)
-	if err != nil {
-		errExit("error initializing cache: %s", err)
+	filtered := len(builders) > 0 || len(categories) > 0 || len(origins) > 0 || len(names) > 0
+	if cleanAll && cleanTrash && filtered {
+		errExit("-x with -E removes all cached data and can't be used with filters")
+	}
+
+	// with size quota, logs are removed by date only if date was given explicitly
+	if cleanQuota >= 0 && !explicitDate {
+		cleanByDate = false
 	}
 
-	if cleanAll {
+	c, p := initCache()
+
+	if cleanAll && cleanTrash && !hasPinned(c) {
+		if cleanDryRun {
+			fmt.Printf("Would remove %s\n", c.Path())
+			return 0
+		}
 		fmt.Printf("Removing %s\n", c.Path())
 		if err := c.Remove(); err != nil {
 			errExit("error removing cache: %s", err)
@@ -95,23 +163,218 @@ func runClean(args []string) int {
 		return 0
 	}
 
-	w := c.Walker(nil)
-	err = w.Walk(func(entry cache.Entry, err error) error {
+	if cleanTrash && !cleanAll {
+		if cleanDryRun {
+			fmt.Println("Would empty trash.")
+			return 0
+		}
+		freed, err := emptyTrash(c, time.Time{})
 		if err != nil {
-			return err
+			errExit("error emptying trash: %s", err)
 		}
+		fmt.Printf("Emptied trash, freed %s.\n", formatSize(freed))
+		return 0
+	}
 
-		inf := entry.Info()
-		if inf.Timestamp.Before(cleanDateLimit) {
-			fmt.Printf("Removing %s\n", entry)
-			entry.Remove()
+	// removed logs are moved to the trash unless it's disabled,
+	// or everything except pinned logs is being removed
+	var run time.Time
+	if p.trashDays > 0 && !(cleanAll && cleanTrash) {
+		run = time.Now()
+		if !cleanDryRun {
+			if _, err := emptyTrash(c, run.AddDate(0, 0, -p.trashDays)); err != nil {
+				errExit("error emptying trash: %s", err)
+			}
 		}
+	}
 
-		return nil
+	entries, err := collectEntries(c, &cache.Filter{
+		Builders:   builders,
+		Categories: categories,
+		Origins:    origins,
+		Names:      names,
 	})
 	if err != nil {
 		errExit("error: %s", err)
 	}
 
+	// logs that are never removed
+	keep := keepLatest(entries, cleanKeep)
+	for _, ce := range entries {
+		if ce.pinned {
+			keep[ce] = true
+		}
+	}
+
+	var candidates, remove, evict []*cleanEntry
+	for _, ce := range entries {
+		if keep[ce] {
+			continue
+		}
+		if cleanAll || cleanByDate && ce.info.Timestamp.Before(cleanDateLimit) {
+			remove = append(remove, ce)
+		} else {
+			candidates = append(candidates, ce)
+		}
+	}
+	if cleanQuota >= 0 {
+		total, refs, err := cacheUsage(c)
+		if err != nil {
+			errExit("error: %s", err)
+		}
+		// account for logs that are already going to be removed permanently,
+		// trashed ones keep their contents on disk
+		if run.IsZero() {
+			for _, ce := range remove {
+				if refs[ce.st.ContentID]--; refs[ce.st.ContentID] == 0 {
+					total -= ce.st.Size
+				}
+			}
+		}
+		evict = selectForQuota(candidates, total, refs, cleanQuota, cleanLRU)
+	}
+
+	freed, err := removeEntries(c, remove, run, cleanDryRun)
+	if err != nil {
+		errExit("error: %s", err)
+	}
+	// trashing logs wouldn't free any space, so logs over quota are removed permanently
+	evictFreed, err := removeEntries(c, evict, time.Time{}, cleanDryRun)
+	if err != nil {
+		errExit("error: %s", err)
+	}
+
+	if cleanAll && cleanTrash && !cleanDryRun {
+		if _, err := emptyTrash(c, time.Time{}); err != nil {
+			errExit("error emptying trash: %s", err)
+		}
+	}
+
+	switch {
+	case len(remove)+len(evict) == 0:
+		fmt.Println("Nothing to remove.")
+	case cleanDryRun:
+		fmt.Printf("Would remove %d log(s), freeing %s.\n", len(remove)+len(evict), formatSize(freed+evictFreed))
+	case run.IsZero():
+		fmt.Printf("Removed %d log(s), freed %s.\n", len(remove)+len(evict), formatSize(freed+evictFreed))
+	default:
+		if len(remove) > 0 {
+			fmt.Printf("Moved %d log(s) to trash, %s will be freed when it's emptied.\n", len(remove), formatSize(freed))
+		}
+		if len(evict) > 0 {
+			fmt.Printf("Removed %d log(s) over quota, freed %s.\n", len(evict), formatSize(evictFreed))
+		}
+	}
+
 	return 0
 }
+
+// cleanEntry holds cache entry attributes used by cleaning.
+type cleanEntry struct {
+	entry  cache.Entry
+	info   cache.EntryInfo
+	st     cache.EntryStat
+	pinned bool
+}
+
+// collectEntries returns all cache entries that made it through the filter.
+func collectEntries(c cache.Cacher, filter *cache.Filter) ([]*cleanEntry, error) {
+	var res []*cleanEntry
+	err := c.Walker(filter).Walk(func(entry cache.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		st, err := entry.Stat()
+		if err != nil {
+			return err
+		}
+		res = append(res, &cleanEntry{
+			entry:  entry,
+			info:   entry.Info(),
+			st:     st,
+			pinned: entry.Pinned(),
+		})
+		return nil
+	})
+	return res, err
+}
+
+// hasPinned returns true if the cache has any pinned entries.
+func hasPinned(c cache.Cacher) bool {
+	var pinned bool
+	_ = c.Walker(nil).Walk(func(entry cache.Entry, err error) error {
+		if err == nil && entry.Pinned() {
+			pinned = true
+			return cache.Stop
+		}
+		return nil
+	})
+	return pinned
+}
+
+// keepLatest returns count latest entries for each builder and origin.
+func keepLatest(entries []*cleanEntry, count int) map[*cleanEntry]bool {
+	res := map[*cleanEntry]bool{}
+	if count <= 0 {
+		return res
+	}
+
+	// entries are walked in the builder, origin and timestamp order
+	for i := len(entries) - 1; i >= 0; {
+		ce := entries[i]
+		n := 0
+		for ; i >= 0 && entries[i].info.Builder == ce.info.Builder && entries[i].info.Origin == ce.info.Origin; i-- {
+			if n < count {
+				res[entries[i]] = true
+				n++
+			}
+		}
+	}
+	return res
+}
+
+// removeEntries moves entries to the trash under run, or removes them permanently
+// if run is zero, or only prints them if dryRun is true.
+// It returns the number of bytes freed, or to be freed when the trash is emptied.
+func removeEntries(c cache.Cacher, entries []*cleanEntry, run time.Time, dryRun bool) (int64, error) {
+	var freed int64
+	// number of removed entries by content ID
+	removed := map[string]int{}
+
+	for _, ce := range entries {
+		switch {
+		case dryRun:
+			fmt.Printf("Would remove %s (%s)\n", ce.entry, formatSize(ce.st.Size))
+		case !run.IsZero():
+			fmt.Printf("Trashing %s\n", ce.entry)
+			if err := c.Trash().Put(run, ce.entry); err != nil {
+				return freed, err
+			}
+		default:
+			fmt.Printf("Removing %s\n", ce.entry)
+			if err := ce.entry.Remove(); err != nil {
+				return freed, err
+			}
+		}
+		// contents are freed only when the last referencing entry is removed
+		if removed[ce.st.ContentID]++; removed[ce.st.ContentID] == ce.st.Refs {
+			freed += ce.st.Size
+		}
+	}
+
+	if !dryRun && len(entries) > 0 {
+		if _, err := c.Prune(); err != nil {
+			return freed, fmt.Errorf("error pruning cache: %w", err)
+		}
+	}
+	return freed, nil
+}
+
+// emptyTrash permanently removes logs trashed before the given time, or all of them
+// if before is zero. It returns the number of bytes freed.
+func emptyTrash(c cache.Cacher, before time.Time) (int64, error) {
+	if err := c.Trash().Empty(before); err != nil {
+		return 0, err
+	}
+	return c.Prune()
+}
@@ -8,26 +8,28 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/dmgk/fallout/cache"
 	"github.com/dmgk/fallout/fetch"
 	"github.com/dmgk/getopt"
 	"github.com/mattn/go-isatty"
 )
 
 var fetchUsageTmpl = template.Must(template.New("usage-fetch").Parse(`
-usage: {{.progname}} fetch [-h] [-D days] [-A date] [-N count] [-b builder[,builder]] [-c category[,category]] [-o origin[,origin]] [-n name[,name]]
+usage: {{.progname}} fetch [-h] [-u url] [-D days] [-A date] [-N count] [-b builder[,builder]] [-c category[,category]] [-o origin[,origin]] [-n name[,name]]
 
 Download and cache fallout logs.
 
 Options:
   -h              show help and exit
+  -u url          download logs from this mail list archive (default: profile fetch source)
   -D days         download logs for the last days (default: {{.daysLimit}})
   -A date         download only logs after this date, in RFC-3339 format (default: {{.dateLimit.Format .dateFormat}})
   -N count        download only recent count logs
   -b builder,...  download only logs from these builders
   -c category,... download only logs for these categories
-  -o origin,...   download only logs for these origins
+  -o origin,...   download only logs for these origins, use origin@flavor for a single flavor
   -n name,...     download only logs for these port names
+                  values can be globs, e.g. -o 'devel/py-*', or regexps prefixed with ~, e.g. -b '~^main-.*-default$'
+                  prefix a value with ! to exclude it, e.g. -b '!i386'
 `[1:]))
 
 var fetchCmd = command{
@@ -42,6 +44,7 @@ var (
 	fetchCountLimit int
 	fetchDateLimit  = time.Now().UTC().AddDate(0, 0, -defaultFetchDaysLimit)
 	fetchOnlyNew    = true
+	fetchURL        string
 )
 
 func showFetchUsage() {
@@ -57,7 +60,7 @@ func showFetchUsage() {
 }
 
 func runFetch(args []string) int {
-	opts, err := getopt.NewArgv("hD:A:N:b:c:o:n:", argsWithDefaults(args, "FALLOUT_FETCH_OPTS"))
+	opts, err := getopt.NewArgv("hu:D:A:N:b:c:o:n:", argsWithDefaults(args, "FALLOUT_FETCH_OPTS"))
 	if err != nil {
 		panic(fmt.Sprintf("error creating options parser: %s", err))
 	}
@@ -72,6 +75,8 @@ func runFetch(args []string) int {
 		case 'h':
 			showFetchUsage()
 			os.Exit(0)
+		case 'u':
+			fetchURL = opt.String()
 		case 'D':
 			v, err := opt.Int()
 			if err != nil {
@@ -116,12 +121,12 @@ func runFetch(args []string) int {
 	}
 
 	var count uint32
-	c, err := cache.NewDefaultDirectory(progname)
-	if err != nil {
-		errExit("error initializing cache: %s", err)
+	c, p := initCache()
+	if fetchURL == "" {
+		fetchURL = p.fetchURL
 	}
 
-	f := fetch.NewMaillist(fmt.Sprintf("%s/%s", progname, version))
+	f := fetch.NewMaillist(fmt.Sprintf("%s/%s", progname, version), fetchURL)
 	fflt := &fetch.Filter{
 		After:      fetchDateLimit,
 		Limit:      fetchCountLimit,
@@ -177,5 +182,15 @@ func runFetch(args []string) int {
 		fmt.Println("No new logs.")
 	}
 
+	if p.quota > 0 {
+		n, freed, err := evictToQuota(c, p.quota, p.quotaLRU)
+		if err != nil {
+			errExit("error enforcing cache quota: %s", err)
+		}
+		if n > 0 {
+			fmt.Printf("Cache quota %s exceeded, removed %d log(s), freed %s.\n", formatSize(p.quota), n, formatSize(freed))
+		}
+	}
+
 	return 0
 }
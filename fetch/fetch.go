@@ -21,10 +21,12 @@ type Filter struct {
 	// Download only this many most recent logs.
 	Limit int
 	// Allowed builder names, partial names are ok.
+	// Values prefixed with "!" are excluded, globs and "~regexp" are also supported,
+	// see package pattern. This applies to all the lists below.
 	Builders []string
 	// Allowed categories, partial names are ok.
 	Categories []string
-	// Allowed origins, partial names are ok.
+	// Allowed origins, only full origins are ok. Origins without @flavor allow all port flavors.
 	Origins []string
 	// Allowed port names, partial names are ok.
 	Names []string
@@ -37,8 +39,10 @@ type ResultFunc func(res *Result, err error) error
 type Result struct {
 	// Log builder name.
 	Builder string
-	// Log port origin.
+	// Log port origin, category/name with an optional @flavor suffix.
 	Origin string
+	// Log port flavor, empty if the port isn't flavored.
+	Flavor string
 	// Log timestamp.
 	Timestamp time.Time
 	// Log content URL.
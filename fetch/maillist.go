@@ -9,21 +9,34 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dmgk/fallout/pattern"
 	"github.com/gocolly/colly/v2"
 )
 
 // Maillist implements Fetcher that scrapes logs from pkg-fallout mail list archives.
 type Maillist struct {
-	filter    Filter
-	collector *colly.Collector
+	filter Filter
+	// compiled filter terms
+	builders   *pattern.List
+	categories *pattern.List
+	origins    *pattern.List
+	names      *pattern.List
+	collector  *colly.Collector
+	// mail list archive URL
+	url string
 }
 
-func NewMaillist(userAgent string) Fetcher {
+// DefaultMaillistURL is the pkg-fallout mail list archive URL.
+const DefaultMaillistURL = "https://lists.freebsd.org/archives/freebsd-pkg-fallout/"
+
+// NewMaillist returns Fetcher that scrapes the mail list archive at url.
+func NewMaillist(userAgent, url string) Fetcher {
 	c := colly.NewCollector(
 		colly.UserAgent(userAgent),
 	)
 	return &Maillist{
 		collector: c,
+		url:       url,
 	}
 }
 
@@ -31,6 +44,9 @@ func (f *Maillist) Fetch(filter *Filter, qfn QueryFunc, rfn ResultFunc) error {
 	if filter != nil {
 		f.filter = *filter
 	}
+	if err := f.compileFilter(); err != nil {
+		return err
+	}
 	rch := make(chan *Result)
 	ech := make(chan error)
 
@@ -67,8 +83,6 @@ func (f *Maillist) Fetch(filter *Filter, qfn QueryFunc, rfn ResultFunc) error {
 	return nil
 }
 
-const baseUrl = "https://lists.freebsd.org/archives/freebsd-pkg-fallout/"
-
 var (
 	builderAndOriginRe = regexp.MustCompile(`\[.+ - (.+)\]\[(.+)\].*`)
 	timestampRe        = regexp.MustCompile(`\((.*)\)`)
@@ -165,9 +179,11 @@ func (f *Maillist) fetchMaillist(ctx context.Context, qfn QueryFunc, rch chan *R
 				//     <i>pkg-fallout_at_FreeBSD.org (Fri, 01 Jul 2022 00:08:34 UTC)</i>
 				//   </li>
 				//
+				// Flavored ports have origins with the flavor suffix, e.g. [devel/py-foo@py39].
+				//
 				// We're assuming this page is a message index, in the ascending order by the message date.
 
-				var builder, origin, category, name, url string
+				var builder, origin, flavor, category, name, url string
 				var ts time.Time
 				var err error
 
@@ -178,7 +194,8 @@ func (f *Maillist) fetchMaillist(ctx context.Context, qfn QueryFunc, rch chan *R
 				}
 				builder = m[0][1]
 				origin = m[0][2]
-				if cn := strings.Split(origin, "/"); len(cn) == 2 {
+				port, flavor, _ := strings.Cut(origin, pattern.FlavorSeparator)
+				if cn := strings.Split(port, "/"); len(cn) == 2 {
 					category, name = cn[0], cn[1]
 				}
 
@@ -213,6 +230,7 @@ func (f *Maillist) fetchMaillist(ctx context.Context, qfn QueryFunc, rch chan *R
 					resMap[url] = &Result{
 						Builder:   builder,
 						Origin:    origin,
+						Flavor:    flavor,
 						Timestamp: ts,
 						URL:       url,
 					}
@@ -254,33 +272,39 @@ func (f *Maillist) fetchMaillist(ctx context.Context, qfn QueryFunc, rch chan *R
 		ech <- err
 	})
 
-	f.collector.Visit(baseUrl)
+	f.collector.Visit(f.url)
 }
 
 func (f *Maillist) builderAllowed(builder string) bool {
-	return valueAllowed(builder, f.filter.Builders, false)
+	return f.builders.Match(builder)
 }
 
 func (f *Maillist) categoryAllowed(category string) bool {
-	return valueAllowed(category, f.filter.Categories, false)
+	return f.categories.Match(category)
 }
 
 func (f *Maillist) originAllowed(origin string) bool {
-	return valueAllowed(origin, f.filter.Origins, true)
+	return f.origins.Match(origin)
 }
 
 func (f *Maillist) nameAllowed(name string) bool {
-	return valueAllowed(name, f.filter.Names, false)
+	return f.names.Match(name)
 }
 
-func valueAllowed(value string, filter []string, exact bool) bool {
-	if len(filter) == 0 {
-		return true
+// compileFilter compiles filter terms, see package pattern for the terms syntax.
+func (f *Maillist) compileFilter() error {
+	var err error
+	if f.builders, err = pattern.Compile(f.filter.Builders, pattern.Partial); err != nil {
+		return err
 	}
-	for _, s := range filter {
-		if exact && value == s || !exact && strings.Contains(value, s) {
-			return true
-		}
+	if f.categories, err = pattern.Compile(f.filter.Categories, pattern.Partial); err != nil {
+		return err
+	}
+	if f.origins, err = pattern.Compile(f.filter.Origins, pattern.Flavored); err != nil {
+		return err
 	}
-	return false
+	if f.names, err = pattern.Compile(f.filter.Names, pattern.Partial); err != nil {
+		return err
+	}
+	return nil
 }
@@ -3,6 +3,7 @@ package format
 import (
 	"bytes"
 	"io"
+	"strconv"
 	"sync"
 
 	"github.com/dmgk/fallout/cache"
@@ -13,6 +14,10 @@ import (
 const (
 	Fcolor = 1 << iota
 	FfilenamesOnly
+	FmarkPinned
+	FlineNumbers
+	Fcount
+	FmatchedPatterns
 
 	Fdefaults = 0
 )
@@ -88,10 +93,27 @@ func (f *textFormatter) Format(entry cache.Entry, matches []*grep.Match) error {
 
 	if f.flags&FfilenamesOnly != 0 {
 		buf.WriteString(entry.Path())
+		f.writePinned(buf, entry)
+		f.writePatterns(buf, matches)
 		buf.WriteByte('\n')
 		return f.write(buf)
 	}
 
+	if matches != nil && f.flags&Fcount != 0 {
+		f.writeColored(buf, cpath, entry.Path())
+		f.writePinned(buf, entry)
+		f.writePatterns(buf, matches)
+		buf.WriteByte(':')
+		buf.WriteString(strconv.Itoa(grep.CountLines(matches)))
+		buf.WriteByte('\n')
+		return f.write(buf)
+	}
+
+	if matches != nil && f.flags&FlineNumbers != 0 {
+		f.formatLines(buf, entry, matches)
+		return f.write(buf)
+	}
+
 	if matches != nil {
 		if f.flags&Fcolor != 0 {
 			buf.WriteString(colors[cpath])
@@ -100,6 +122,8 @@ func (f *textFormatter) Format(entry cache.Entry, matches []*grep.Match) error {
 		} else {
 			buf.WriteString(entry.Path())
 		}
+		f.writePinned(buf, entry)
+		f.writePatterns(buf, matches)
 		buf.WriteString(":\n")
 
 		for i, m := range matches {
@@ -116,19 +140,7 @@ func (f *textFormatter) Format(entry cache.Entry, matches []*grep.Match) error {
 				}
 			}
 
-			if f.flags&Fcolor != 0 {
-				if m.ResultSubmatch != nil {
-					formatBuf.Write(m.Text[:m.ResultSubmatch[0]])
-					formatBuf.WriteString(colors[cmatch])
-					formatBuf.Write(m.Text[m.ResultSubmatch[0]:m.ResultSubmatch[1]])
-					formatBuf.WriteString(creset)
-					formatBuf.Write(m.Text[m.ResultSubmatch[1]:])
-				} else {
-					formatBuf.Write(m.Text)
-				}
-			} else {
-				formatBuf.Write(m.Text)
-			}
+			f.writeText(formatBuf, m, 0, len(m.Text))
 
 			buf.Write(formatBuf.Bytes())
 		}
@@ -139,6 +151,118 @@ func (f *textFormatter) Format(entry cache.Entry, matches []*grep.Match) error {
 	return nil
 }
 
+// formatLines writes matches in grep(1) style, each line prefixed with the log path and the line number,
+// followed by ':' for matching lines and by '-' for context lines.
+func (f *textFormatter) formatLines(buf *bytes.Buffer, entry cache.Entry, matches []*grep.Match) {
+	for i, m := range matches {
+		if i > 0 && (hasContext(matches[i-1]) || hasContext(m)) {
+			f.writeColored(buf, cseparator, "--")
+			buf.WriteByte('\n')
+		}
+
+		num, li := m.StartLine, 0
+		for pos := 0; pos < len(m.Text); num++ {
+			end := len(m.Text)
+			if j := bytes.IndexByte(m.Text[pos:], '\n'); j >= 0 {
+				end = pos + j
+			}
+
+			sep := "-"
+			for li < len(m.Lines) && m.Lines[li] < num {
+				li++
+			}
+			if li < len(m.Lines) && m.Lines[li] == num {
+				sep = ":"
+			}
+
+			f.writeColored(buf, cpath, entry.Path())
+			f.writeColored(buf, cseparator, sep)
+			buf.WriteString(strconv.Itoa(num))
+			f.writeColored(buf, cseparator, sep)
+			f.writeText(buf, m, pos, end)
+			buf.WriteByte('\n')
+
+			pos = end + 1
+		}
+	}
+}
+
+// hasContext returns true if m has any context lines.
+func hasContext(m *grep.Match) bool {
+	return len(m.Lines) < m.EndLine-m.StartLine+1
+}
+
+// writeText writes m.Text between offsets from and to, highlighting query matches in color mode.
+func (f *textFormatter) writeText(buf *bytes.Buffer, m *grep.Match, from, to int) {
+	if f.flags&Fcolor == 0 {
+		buf.Write(m.Text[from:to])
+		return
+	}
+
+	subs := m.Submatches
+	if subs == nil && m.ResultSubmatch != nil {
+		subs = [][]int{m.ResultSubmatch}
+	}
+	pos := from
+	for _, sm := range subs {
+		if sm[1] <= pos || sm[0] >= to {
+			continue
+		}
+		start, end := sm[0], sm[1]
+		if start < pos {
+			start = pos
+		}
+		if end > to {
+			end = to
+		}
+		buf.Write(m.Text[pos:start])
+		buf.WriteString(colors[cmatch])
+		buf.Write(m.Text[start:end])
+		buf.WriteString(creset)
+		pos = end
+	}
+	buf.Write(m.Text[pos:to])
+}
+
+// writeColored writes s using color c in color mode.
+func (f *textFormatter) writeColored(buf *bytes.Buffer, c int, s string) {
+	if f.flags&Fcolor != 0 {
+		buf.WriteString(colors[c])
+		buf.WriteString(s)
+		buf.WriteString(creset)
+	} else {
+		buf.WriteString(s)
+	}
+}
+
+// PinnedMark marks pinned entries in the output.
+const PinnedMark = " (pinned)"
+
+func (f *textFormatter) writePinned(buf *bytes.Buffer, entry cache.Entry) {
+	if f.flags&FmarkPinned != 0 && entry.Pinned() {
+		buf.WriteString(PinnedMark)
+	}
+}
+
+// writePatterns writes the list of pattern list patterns matching in the log.
+func (f *textFormatter) writePatterns(buf *bytes.Buffer, matches []*grep.Match) {
+	if f.flags&FmatchedPatterns == 0 {
+		return
+	}
+	patterns := grep.MatchedPatterns(matches)
+	if len(patterns) == 0 {
+		return
+	}
+	buf.WriteString(" (matched ")
+	for i, p := range patterns {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		f.writeColored(buf, cmatch, strconv.Quote(p))
+	}
+	buf.WriteByte(')')
+}
+
 func (f *textFormatter) write(buf *bytes.Buffer) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
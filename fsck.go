@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+
+	"github.com/dmgk/fallout/cache"
+	"github.com/dmgk/getopt"
+)
+
+var fsckUsageTmpl = template.Must(template.New("usage-fsck").Parse(`
+usage: {{.progname}} fsck [-hr]
+
+Check log cache integrity.
+
+Options:
+  -h              show help and exit
+  -r, --repair    repair found problems, broken logs are removed and will be downloaded again by fetch
+`[1:]))
+
+var fsckCmd = command{
+	Name:    "fsck",
+	Summary: "check log cache integrity",
+	run:     runFsck,
+}
+
+var fsckRepair bool
+
+func showFsckUsage() {
+	err := fsckUsageTmpl.Execute(os.Stdout, map[string]any{
+		"progname": progname,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("error executing template %s: %v", fsckUsageTmpl.Name(), err))
+	}
+}
+
+func runFsck(args []string) int {
+	const optstring = "hr"
+	opts, err := getopt.NewArgv(optstring, expandLongOptions(args, optstring, map[string]byte{
+		"repair": 'r',
+	}))
+	if err != nil {
+		panic(fmt.Sprintf("error creating options parser: %s", err))
+	}
+
+	for opts.Scan() {
+		opt, err := opts.Option()
+		if err != nil {
+			errExit(err.Error())
+		}
+
+		switch opt.Opt {
+		case 'h':
+			showFsckUsage()
+			os.Exit(0)
+		case 'r':
+			fsckRepair = true
+		default:
+			panic("unhandled option: -" + string(opt.Opt))
+		}
+	}
+
+	c, _ := initCache()
+
+	var found, repaired int
+	err = c.Check(func(p *cache.Problem) error {
+		found++
+		if !fsckRepair {
+			fmt.Println(p)
+			return nil
+		}
+		if err := p.Repair(); err != nil {
+			fmt.Printf("%s (repair failed: %s)\n", p, err)
+			return nil
+		}
+		repaired++
+		fmt.Printf("%s (repaired)\n", p)
+		return nil
+	})
+	if err != nil {
+		errExit("error: %s", err)
+	}
+
+	switch {
+	case found == 0:
+		fmt.Println("No problems found.")
+	case fsckRepair:
+		fmt.Printf("Found %d problem(s), repaired %d.\n", found, repaired)
+	default:
+		fmt.Printf("Found %d problem(s), run with -r to repair.\n", found)
+	}
+	if found > repaired {
+		return 1
+	}
+
+	return 0
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/dmgk/fallout/cache"
@@ -17,25 +18,48 @@ import (
 )
 
 var grepUsageTmpl = template.Must(template.New("usage-grep").Parse(`
-usage: {{.progname}} grep [-hFOl] [-A count] [-B count] [-C count] [-b builder[,builder]] [-c category[,category]] [-o origin[,origin]] [-n name[,name]] [-s since] [-e before] [-j jobs] query [query ...]
+usage: {{.progname}} grep [-hFiwxOlNpKUG1tT] [-A count] [-B count] [-C count] [-m count] [-L count] [-v query] [-q expression] [-f file] [-b builder[,builder]] [-c category[,category]] [-o origin[,origin]] [-n name[,name]] [-s since] [-e before] [-S order] [-j jobs] query [query ...]
 
 Search cached fallout logs.
 
 Options:
   -h              show help and exit
   -F              interpret query as a plain text, not regular expression
+  -i              ignore case distinctions, also --ignore-case
+  -w              match only whole words, also --word-regexp
+  -x              match only whole lines, also --line-regexp
   -O              multiple queries are OR-ed (default: AND-ed)
   -l              print only matching log filenames
+  -N              prefix each output line with the log path and the line number, also --line-number
+  -p              mark pinned logs, also --mark-pinned
+  -K              print only the number of matching lines in each log, also --count
+  -U              print only the number of matching logs by builder, category and day, also --summary
+  -G              print only the most common matching lines with the number and origins of logs
+                  having them, paths, line numbers, versions and addresses are ignored, also --group
+  -1              stop after the first matching log, same as -L1, also --first
+  -t              search only the latest log for each builder and origin, also --latest
+  -T              search only the latest log for each origin across all builders, also --latest-origin
   -A count        show count lines of context after match
   -B count        show count lines of context before match
   -C count        show count lines of context around match
+  -m count        show only the first count matching lines of each log, also --max-count
+  -L count        stop after count matching logs, also --max-logs
+  -v query        skip logs matching query, can be repeated, also --not
+                  with only -v queries, matching log filenames are printed
+  -q expression   search for query expression, also --query, e.g.
+                  -q '(clang-16 OR clang-17) AND "error:" AND NOT "-Werror"'
+  -f file         search for any of the patterns from file, one per line, also --file
+                  patterns matching each log are reported, plain text patterns are searched for all at once
   -b builder,...  limit search only to these builders
   -c category,... limit search only to these categories
-  -o origin,...   limit search only to these origins
+  -o origin,...   limit search only to these origins, use origin@flavor for a single flavor
   -n name,...     limit search only to these port names
+                  values can be globs, e.g. -o 'devel/py-*', or regexps prefixed with ~, e.g. -b '~^main-.*-default$'
+                  prefix a value with ! to exclude it, e.g. -b '!i386'
   -s since        list only failures since this date or date-time, in RFC-3339 format
   -e before       list only failures before this date or date-time, in RFC-3339 format
-  -j jobs         number of parallel jobs, -j1 outputs sorted results (default: {{.maxJobs}})
+  -S order        output logs in this order [{{.orders}}], also --sort (default: {{.order}})
+  -j jobs         number of parallel jobs, output is always in the -S order (default: {{.maxJobs}})
 `[1:]))
 
 var grepCmd = command{
@@ -46,18 +70,35 @@ var grepCmd = command{
 
 var (
 	grepQueryIsRegexp = true
+	grepIgnoreCase    bool
+	grepWholeWord     bool
+	grepWholeLine     bool
 	grepOr            bool
 	grepFilenamesOnly bool
+	grepLineNumbers   bool
+	grepMarkPinned    bool
+	grepCount         bool
+	grepSummary       bool
+	grepGroup         bool
 	grepContextAfter  int
 	grepContextBefore int
+	grepMaxCount      int
+	grepMaxLogs       int
+	grepNegated       []string
+	grepExpression    string
+	grepPatterns      []string
 	grepSince         time.Time
 	grepBefore        time.Time
+	grepOrder         cache.Order
+	grepLatest        cache.Latest
 	grepMaxJobs       = runtime.NumCPU()
 )
 
 func showGrepUsage() {
 	err := grepUsageTmpl.Execute(os.Stdout, map[string]any{
 		"progname": progname,
+		"orders":   strings.Join(cache.OrderNames(), "|"),
+		"order":    grepOrder,
 		"maxJobs":  grepMaxJobs,
 	})
 	if err != nil {
@@ -66,7 +107,26 @@ func showGrepUsage() {
 }
 
 func runGrep(args []string) int {
-	opts, err := getopt.NewArgv("hFOlA:B:C:b:c:o:n:s:e:j:", argsWithDefaults(args, "FALLOUT_GREP_OPTS"))
+	const optstring = "hFiwxOlNpKUG1tTA:B:C:m:L:v:q:f:b:c:o:n:s:e:S:j:"
+	opts, err := getopt.NewArgv(optstring, expandLongOptions(argsWithDefaults(args, "FALLOUT_GREP_OPTS"), optstring, map[string]byte{
+		"sort":          'S',
+		"max-count":     'm',
+		"max-logs":      'L',
+		"first":         '1',
+		"ignore-case":   'i',
+		"word-regexp":   'w',
+		"line-regexp":   'x',
+		"line-number":   'N',
+		"mark-pinned":   'p',
+		"count":         'K',
+		"summary":       'U',
+		"group":         'G',
+		"not":           'v',
+		"query":         'q',
+		"file":          'f',
+		"latest":        't',
+		"latest-origin": 'T',
+	}))
 	if err != nil {
 		panic(fmt.Sprintf("error creating options parser: %s", err))
 	}
@@ -83,29 +143,88 @@ func runGrep(args []string) int {
 			os.Exit(0)
 		case 'F':
 			grepQueryIsRegexp = false
+		case 'i':
+			grepIgnoreCase = true
+		case 'w':
+			grepWholeWord = true
+		case 'x':
+			grepWholeLine = true
 		case 'O':
 			grepOr = true
 		case 'l':
 			grepFilenamesOnly = true
+		case 'N':
+			grepLineNumbers = true
+		case 'p':
+			grepMarkPinned = true
+		case 'K':
+			grepCount = true
+		case 'U':
+			grepSummary = true
+		case 'G':
+			grepGroup = true
+		case 't':
+			grepLatest = cache.LatestPerBuilder
+		case 'T':
+			grepLatest = cache.LatestPerOrigin
 		case 'A':
 			v, err := opt.Int()
 			if err != nil {
 				errExit("-A: %s", err)
 			}
+			if v < 0 {
+				errExit("-A: negative count: %d", v)
+			}
 			grepContextAfter = v
 		case 'B':
 			v, err := opt.Int()
 			if err != nil {
 				errExit("-B: %s", err)
 			}
+			if v < 0 {
+				errExit("-B: negative count: %d", v)
+			}
 			grepContextBefore = v
 		case 'C':
 			v, err := opt.Int()
 			if err != nil {
 				errExit("-C: %s", err)
 			}
+			if v < 0 {
+				errExit("-C: negative count: %d", v)
+			}
 			grepContextBefore = v
 			grepContextAfter = v
+		case 'm':
+			v, err := opt.Int()
+			if err != nil {
+				errExit("-m: %s", err)
+			}
+			if v < 0 {
+				errExit("-m: negative count: %d", v)
+			}
+			grepMaxCount = v
+		case 'L':
+			v, err := opt.Int()
+			if err != nil {
+				errExit("-L: %s", err)
+			}
+			if v < 0 {
+				errExit("-L: negative count: %d", v)
+			}
+			grepMaxLogs = v
+		case '1':
+			grepMaxLogs = 1
+		case 'v':
+			grepNegated = append(grepNegated, opt.String())
+		case 'q':
+			grepExpression = opt.String()
+		case 'f':
+			p, err := readPatterns(opt.String())
+			if err != nil {
+				errExit("-f: %s", err)
+			}
+			grepPatterns = append(grepPatterns, p...)
 		case 'b':
 			builders = splitOptions(opt.String())
 		case 'c':
@@ -126,6 +245,12 @@ func runGrep(args []string) int {
 				errExit("-e: %s", err)
 			}
 			grepBefore = t
+		case 'S':
+			o, err := cache.ParseOrder(opt.String())
+			if err != nil {
+				errExit("-S: %s", err)
+			}
+			grepOrder = o
 		case 'j':
 			v, err := opt.Int()
 			if err != nil {
@@ -150,10 +275,7 @@ func runGrep(args []string) int {
 		}
 	}
 
-	c, err := cache.NewDefaultDirectory(progname)
-	if err != nil {
-		errExit("error initializing cache: %s", err)
-	}
+	c, _ := initCache()
 
 	cflt := &cache.Filter{
 		Builders:   builders,
@@ -162,20 +284,30 @@ func runGrep(args []string) int {
 		Names:      names,
 		Since:      grepSince,
 		Before:     grepBefore,
+		Order:      grepOrder,
+		Latest:     grepLatest,
 	}
 	w := c.Walker(cflt)
 
 	// list only log filenames if no queries were provided
-	if len(opts.Args()) == 0 {
+	if len(opts.Args()) == 0 && len(grepNegated) == 0 && grepExpression == "" && len(grepPatterns) == 0 && !grepSummary {
 		grepFilenamesOnly = true
 
 		// no need to actually grep if no queries were provided and only filenames were requested
-		// simple cache walk is enough and also will output results ordered by builder/origin/timestamp
+		// simple cache walk is enough and also will output results in the walk order
+		var count int
 		err = w.Walk(func(entry cache.Entry, err error) error {
 			if err != nil {
 				return err
 			}
-			fmt.Println(entry)
+			if grepMarkPinned && entry.Pinned() {
+				fmt.Println(entry.String() + format.PinnedMark)
+			} else {
+				fmt.Println(entry)
+			}
+			if count++; grepMaxLogs > 0 && count >= grepMaxLogs {
+				return cache.Stop
+			}
 			return nil
 		})
 		if err != nil {
@@ -186,17 +318,54 @@ func runGrep(args []string) int {
 	}
 
 	g := grep.New(w)
-	fm := initFormatter()
 
 	gopt := &grep.Options{
 		ContextAfter:  grepContextAfter,
 		ContextBefore: grepContextBefore,
+		MaxCount:      grepMaxCount,
+		MaxLogs:       grepMaxLogs,
 		QueryIsRegexp: grepQueryIsRegexp,
+		IgnoreCase:    grepIgnoreCase,
+		WholeWord:     grepWholeWord,
+		WholeLine:     grepWholeLine,
+		Ored:          grepOr,
+		Negated:       grepNegated,
+		Expression:    grepExpression,
+		Patterns:      grepPatterns,
+	}
+
+	// list only log filenames if only negated queries were provided, there are no lines to show
+	if ok, err := grep.HasLineQueries(gopt, opts.Args()); err != nil {
+		errExit("grep error: %s", err)
+	} else if !ok {
+		grepFilenamesOnly = true
+	}
+
+	if grepGroup {
+		groups, err := g.GroupLines(gopt, opts.Args(), grepMaxJobs)
+		if err != nil {
+			errExit("grep error: %s", err)
+		}
+		printGrepGroups(groups)
+		return 0
 	}
+
+	if grepSummary {
+		sum, err := g.Summarize(gopt, opts.Args(), grepMaxJobs)
+		if err != nil {
+			errExit("grep error: %s", err)
+		}
+		printGrepSummary(sum)
+		return 0
+	}
+
+	fm := initFormatter()
+	var matched []cache.Entry
 	gfn := func(entry cache.Entry, res []*grep.Match, err error) error {
 		if err != nil {
 			return err
 		}
+		matched = append(matched, entry)
 		return fm.Format(entry, res)
 	}
 
@@ -205,6 +374,10 @@ func runGrep(args []string) int {
 		return 1
 	}
 
+	// matched logs are recently used, clean -U evicts them last,
+	// they're marked once grepping is done to keep it from writing to the cache
+	_ = c.Touch(matched)
+
 	return 0
 }
 
@@ -222,6 +395,72 @@ func initFormatter() format.Formatter {
 	if grepFilenamesOnly {
 		flags |= format.FfilenamesOnly
 	}
+	if grepCount {
+		flags |= format.Fcount
+	}
+	if len(grepPatterns) > 0 {
+		flags |= format.FmatchedPatterns
+	}
+	if grepLineNumbers {
+		flags |= format.FlineNumbers
+	}
+	if grepMarkPinned {
+		flags |= format.FmarkPinned
+	}
 
 	return format.NewText(w, flags)
 }
+
+// printGrepSummary prints the summary of matching logs.
+func printGrepSummary(sum *grep.Summary) {
+	fmt.Printf("Matching logs: %d (%d lines)\n", sum.Logs, sum.Lines)
+	for _, sec := range []struct {
+		title  string
+		counts []grep.Count
+	}{
+		{"Builders", sum.Builders},
+		{"Categories", sum.Categories},
+		{"Days", sum.Days},
+		{"Patterns", sum.Patterns},
+	} {
+		if len(sec.counts) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s:\n", sec.title)
+		for _, c := range sec.counts {
+			fmt.Printf("  %-32s %d\n", c.Name, c.Logs)
+		}
+	}
+}
+
+// printGrepGroups prints groups of identical matching lines.
+func printGrepGroups(groups []*grep.Group) {
+	for _, gr := range groups {
+		fmt.Printf("%6d  %s\n        %s\n", gr.Logs, gr.Line, strings.Join(gr.Origins, " "))
+	}
+}
+
+// readPatterns reads grep patterns from file, one per line. Empty lines are skipped,
+// a file without any patterns is an error.
+func readPatterns(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if p := strings.TrimSuffix(sc.Text(), "\r"); p != "" {
+			res = append(res, p)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no patterns in %s", path)
+	}
+	return res, nil
+}
@@ -0,0 +1,128 @@
+package grep
+
+// acMatcher is an Aho-Corasick automaton searching for many plain text patterns at once
+// in a single pass over the text. It reports leftmost-longest matches, like regexp does
+// for an alternation of quoted patterns in the Longest mode, but doesn't slow down as the
+// number of patterns grows.
+type acMatcher struct {
+	// byte classes, bytes not appearing in patterns share class 0
+	classes [256]byte
+	nclass  int
+	// transitions, delta[state*nclass+class] is the next state, failures are resolved
+	delta []int32
+	// length of the longest pattern prefix each state represents
+	depth []int32
+	// longest pattern ending at each state, or -1
+	out []int32
+	// pattern lengths
+	lens []int32
+}
+
+// newACMatcher returns an automaton for non-empty patterns. If fold is true,
+// ASCII letters are matched case-insensitively.
+func newACMatcher(patterns []string, fold bool) *acMatcher {
+	ac := &acMatcher{
+		nclass: 1,
+		lens:   make([]int32, len(patterns)),
+	}
+	for i, p := range patterns {
+		ac.lens[i] = int32(len(p))
+		for j := 0; j < len(p); j++ {
+			c := p[j]
+			if fold {
+				c = lowerASCII(c)
+			}
+			if ac.classes[c] == 0 {
+				ac.classes[c] = byte(ac.nclass)
+				ac.nclass++
+			}
+		}
+	}
+	if fold {
+		for c := 'A'; c <= 'Z'; c++ {
+			ac.classes[c] = ac.classes[c+'a'-'A']
+		}
+	}
+
+	// build the trie, 0 is the root state and it's never a transition target,
+	// so 0 in delta means no transition until failures are resolved
+	ac.addState(0)
+	for i, p := range patterns {
+		var s int32
+		for j := 0; j < len(p); j++ {
+			k := int(s)*ac.nclass + int(ac.classes[p[j]])
+			if ac.delta[k] == 0 {
+				ac.delta[k] = ac.addState(ac.depth[s] + 1)
+			}
+			s = ac.delta[k]
+		}
+		if ac.out[s] < 0 {
+			ac.out[s] = int32(i)
+		}
+	}
+
+	// resolve failures breadth first, states closer to the root are complete by the time they're needed
+	fail := make([]int32, len(ac.depth))
+	queue := []int32{0}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for c := 0; c < ac.nclass; c++ {
+			k := int(s)*ac.nclass + c
+			t := ac.delta[k]
+			if t == 0 {
+				// no trie edge, follow the failure state
+				if s != 0 {
+					ac.delta[k] = ac.delta[int(fail[s])*ac.nclass+c]
+				}
+				continue
+			}
+			if s != 0 {
+				fail[t] = ac.delta[int(fail[s])*ac.nclass+c]
+			}
+			if ac.out[t] < 0 {
+				ac.out[t] = ac.out[fail[t]]
+			}
+			queue = append(queue, t)
+		}
+	}
+
+	return ac
+}
+
+func (ac *acMatcher) addState(depth int32) int32 {
+	ac.delta = append(ac.delta, make([]int32, ac.nclass)...)
+	ac.depth = append(ac.depth, depth)
+	ac.out = append(ac.out, -1)
+	return int32(len(ac.depth) - 1)
+}
+
+// find returns the leftmost-longest match in buf starting at from as the absolute
+// {start, end, pattern index} triple, or nil if there's none.
+func (ac *acMatcher) find(buf []byte, from int) []int {
+	var s int32
+	start, end, pat := -1, -1, -1
+	for i := from; i < len(buf); i++ {
+		s = ac.delta[int(s)*ac.nclass+int(ac.classes[buf[i]])]
+		if p := ac.out[s]; p >= 0 {
+			if ms := i + 1 - int(ac.lens[p]); start < 0 || ms < start || ms == start && i+1 > end {
+				start, end, pat = ms, i+1, int(p)
+			}
+		}
+		if start >= 0 && i+1-int(ac.depth[s]) > start {
+			// no longer match starting at or before start is possible
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	return []int{start, end, pat}
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,141 @@
+package grep
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestACMatcherFind(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		fold     bool
+		text     string
+		// expected {start, end, pattern index} triples of successive matches
+		want [][]int
+	}{
+		{
+			name:     "single",
+			patterns: []string{"foo"},
+			text:     "a foo b foo",
+			want:     [][]int{{2, 5, 0}, {8, 11, 0}},
+		},
+		{
+			name:     "leftmost wins over earlier ending",
+			patterns: []string{"bcd", "abcdef"},
+			text:     "xabcdefx",
+			want:     [][]int{{1, 7, 1}},
+		},
+		{
+			name:     "longest at the same start",
+			patterns: []string{"he", "hers", "her"},
+			text:     "ushers",
+			want:     [][]int{{2, 6, 1}},
+		},
+		{
+			name:     "suffix pattern via failure links",
+			patterns: []string{"abcx", "bc"},
+			text:     "abcd",
+			want:     [][]int{{1, 3, 1}},
+		},
+		{
+			name:     "non-overlapping successive matches",
+			patterns: []string{"aa"},
+			text:     "aaaaa",
+			want:     [][]int{{0, 2, 0}, {2, 4, 0}},
+		},
+		{
+			name:     "first of duplicate patterns",
+			patterns: []string{"foo", "foo"},
+			text:     "foo",
+			want:     [][]int{{0, 3, 0}},
+		},
+		{
+			name:     "case-sensitive",
+			patterns: []string{"error"},
+			text:     "ERROR Error error",
+			want:     [][]int{{12, 17, 0}},
+		},
+		{
+			name:     "ignore case",
+			patterns: []string{"error", "Error:"},
+			fold:     true,
+			text:     "ERROR: Error error",
+			want:     [][]int{{0, 6, 1}, {7, 12, 0}, {13, 18, 0}},
+		},
+		{
+			name:     "ignore case longest",
+			patterns: []string{"Werror", "WERROR=yes"},
+			fold:     true,
+			text:     "-werror=YES",
+			want:     [][]int{{1, 11, 1}},
+		},
+		{
+			name:     "no match",
+			patterns: []string{"foo", "bar"},
+			text:     "fo ba",
+			want:     nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := newACMatcher(tt.patterns, tt.fold)
+			var got [][]int
+			for from := 0; ; {
+				loc := ac.find([]byte(tt.text), from)
+				if loc == nil {
+					break
+				}
+				got = append(got, loc)
+				from = loc[1]
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestACMatcherRegexp checks that matches are the same as for the equivalent leftmost-longest regexp.
+func TestACMatcherRegexp(t *testing.T) {
+	patterns := []string{"a", "ab", "abc", "bcd", "cd", "d", "dab", "bb", "cab"}
+	texts := []string{
+		"abcdabcd",
+		"xxdabbcabcd",
+		"bbbcdcdab",
+		"ABCDaBcD",
+		"cdcabab",
+	}
+
+	for _, fold := range []bool{false, true} {
+		var quoted []string
+		for _, p := range patterns {
+			quoted = append(quoted, regexp.QuoteMeta(p))
+		}
+		expr := strings.Join(quoted, "|")
+		if fold {
+			expr = "(?i)" + expr
+		}
+		re := regexp.MustCompile(expr)
+		re.Longest()
+		ac := newACMatcher(patterns, fold)
+
+		for _, text := range texts {
+			want := re.FindAllStringIndex(text, -1)
+			var got [][]int
+			for from := 0; ; {
+				loc := ac.find([]byte(text), from)
+				if loc == nil {
+					break
+				}
+				got = append(got, loc[:2])
+				from = loc[1]
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("fold=%v %q: got %v, want %v", fold, text, got, want)
+			}
+		}
+	}
+}
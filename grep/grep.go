@@ -1,9 +1,8 @@
 package grep
 
 import (
+	"bytes"
 	"errors"
-	"fmt"
-	"regexp"
 	"sync"
 
 	"github.com/dmgk/fallout/cache"
@@ -22,24 +21,70 @@ func New(walker cache.Walker) *Grepper {
 }
 
 type Options struct {
-	// Number of context lines before the match.
-	ContextAfter int
 	// Number of context lines after the match.
+	ContextAfter int
+	// Number of context lines before the match.
 	ContextBefore int
+	// Maximum number of matching lines reported for each log, 0 if there's no limit.
+	MaxCount int
+	// Stop after this many matching logs, 0 if there's no limit.
+	MaxLogs int
 	// Treat queries as a regular expressions, not as a plain text.
 	QueryIsRegexp bool
+	// Ignore case distinctions in queries and logs.
+	IgnoreCase bool
+	// Match only whole words, not preceded or followed by a letter, a digit or an underscore.
+	WholeWord bool
+	// Match only whole lines.
+	WholeLine bool
 	// At least one query needs to match, not all of them.
 	Ored bool
+	// Negated queries, logs matching any of them are skipped.
+	// If there are only negated queries, the whole text of the remaining logs is returned.
+	Negated []string
+	// Pattern list, at least one of the patterns needs to match in addition to the other queries.
+	// Empty patterns are ignored, but the list needs to have at least one non-empty pattern.
+	Patterns []string
+	// Query expression combining queries with AND, OR and NOT, see query.go for the syntax.
+	// It needs to match in addition to the other queries.
+	Expression string
 }
 
 type GrepFunc func(entry cache.Entry, res []*Match, err error) error
 
-// Match describes one search match result.
+// Match describes one search match result: a block of matching lines with their context.
+// Overlapping or adjacent context of several matching lines is merged into one block.
 type Match struct {
-	// Text holds the match as a byte string.
+	// Text holds the matching lines with their context as a byte string.
 	Text []byte
-	// ResultSubmatch is a byte index pair identifying the result submatch in Text.
+	// ResultSubmatch is a byte index pair identifying the first query match in Text.
 	ResultSubmatch []int
+	// Submatches holds byte index pairs identifying all query matches in Text.
+	Submatches [][]int
+	// Line is the number of the first matching line in the log, starting at 1.
+	Line int
+	// Offset is the byte offset of the first matching line in the log.
+	Offset int
+	// TextOffset is the byte offset of Text in the log.
+	TextOffset int
+	// StartLine and EndLine are the numbers of the first and the last line of Text in the log,
+	// including context lines.
+	StartLine, EndLine int
+	// Lines holds the numbers of all matching lines in Text, in ascending order.
+	Lines []int
+	// Patterns holds Options.Patterns matching in Text, in the order of their first match.
+	Patterns []string
+}
+
+// MatchedPatterns returns Options.Patterns matching in mm, in the order of their first match.
+func MatchedPatterns(mm []*Match) []string {
+	var res []string
+	for _, m := range mm {
+		for _, p := range m.Patterns {
+			res = appendPattern(res, p)
+		}
+	}
+	return res
 }
 
 // Stop is a special value that can be returned by GrepFunc to indicate that
@@ -50,36 +95,80 @@ var Stop = errors.New("stop")
 type grepResult struct {
 	entry cache.Entry
 	mm    []*Match
+	// closed when results were consumed, matches may reference entry contents
+	// that are valid only until then
+	done chan struct{}
+}
+
+// sendResult sends entry matching results to rch and waits until they are consumed.
+// It returns false if grepping was stopped, stop is closed then.
+func sendResult(rch chan *grepResult, stop chan struct{}, entry cache.Entry, mm []*Match) bool {
+	r := &grepResult{
+		entry: entry,
+		mm:    mm,
+		done:  make(chan struct{}),
+	}
+	select {
+	case rch <- r:
+	case <-stop:
+		return false
+	}
+	select {
+	case <-r.done:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// sendError sends err to ech, unless grepping was stopped.
+func sendError(ech chan error, stop chan struct{}, err error) {
+	select {
+	case ech <- err:
+	case <-stop:
+	}
 }
 
 // Grep searches cached logs and calls gfn for each found match.
 func (g *Grepper) Grep(options *Options, queries []string, gfn GrepFunc, jobs int) error {
-	var mrs []*matcher
-	for _, q := range queries {
-		m, err := newMatcher(options, q)
-		if err != nil {
-			return err
-		}
-		mrs = append(mrs, m)
+	q, err := newQuery(options, queries)
+	if err != nil {
+		return err
 	}
 
 	rch := make(chan *grepResult)
 	ech := make(chan error)
-
-	go g.walkCache(mrs, options.Ored, rch, ech, jobs)
-
+	stop := make(chan struct{})
+	walked := make(chan struct{})
+
+	go func() {
+		g.walkCache(q, options, rch, ech, stop, jobs)
+		close(walked)
+	}()
+	defer func() {
+		// stop walking if gfn stopped early, and wait until all pending reads are done
+		close(stop)
+		<-walked
+	}()
+
+	var count int
 	rok := true
 	for rok {
 		var r *grepResult
 		select {
 		case r, rok = <-rch:
 			if rok {
-				if gerr := gfn(r.entry, r.mm, nil); gerr != nil {
+				gerr := gfn(r.entry, r.mm, nil)
+				close(r.done)
+				if gerr != nil {
 					if gerr == Stop {
 						return nil
 					}
 					return gerr
 				}
+				if count++; options.MaxLogs > 0 && count >= options.MaxLogs {
+					return nil
+				}
 			}
 		case err, eok := <-ech:
 			if eok {
@@ -95,132 +184,177 @@ func (g *Grepper) Grep(options *Options, queries []string, gfn GrepFunc, jobs in
 	return nil
 }
 
-// walkCache does matching against cached logs.
-func (g *Grepper) walkCache(mrs []*matcher, ored bool, rch chan *grepResult, ech chan error, jobs int) {
+// walkCache does matching against cached logs, results are sent in the walk order.
+// Contents shared by several entries are matched only once.
+// Walking stops when stop is closed, walkCache returns after all started jobs are done.
+func (g *Grepper) walkCache(q *query, options *Options, rch chan *grepResult, ech chan error, stop chan struct{}, jobs int) {
 	defer close(rch)
 	defer close(ech)
 
 	var wg sync.WaitGroup
 	sem := make(chan int, jobs)
+	shared := &sharedResults{m: map[string]*sharedMatches{}}
+	// a slow log holds back delivery of the following ones, limit how many of them
+	// are kept in memory meanwhile
+	rb := newReorderBuffer(rch, stop, 4*jobs)
+	var seq int
 
 	err := g.walker.Walk(func(entry cache.Entry, err error) error {
 		if err != nil {
 			return err
 		}
 
-		sem <- 1
+		if !rb.wait(seq) {
+			return cache.Stop
+		}
+		select {
+		case sem <- 1:
+		case <-stop:
+			return cache.Stop
+		}
 		wg.Add(1)
 
-		go func() {
+		go func(seq int) {
+			// results are completed with nil matches unless matching succeeds
+			completed := false
 			defer func() {
+				if !completed {
+					rb.complete(seq, entry, nil, true)
+				}
 				<-sem
 				wg.Done()
 			}()
 
-			err := entry.With(func(buf []byte) error {
-				res := &grepResult{
-					entry: entry,
-				}
+			select {
+			case <-stop:
+				return
+			default:
+			}
 
-				// no queries were provided, return the whole text
-				if len(mrs) == 0 {
-					res.mm = []*Match{
-						{Text: buf},
-					}
-					rch <- res
-					return nil
-				}
+			st, err := entry.Stat()
+			if err != nil {
+				sendError(ech, stop, err)
+				return
+			}
 
-				for _, mr := range mrs {
-					m, err := mr.match(buf)
-					if err != nil {
-						return err
+			var sm *sharedMatches
+			if st.Refs > 1 {
+				var first bool
+				if sm, first = shared.get(st); !first {
+					// contents were already matched for another entry
+					select {
+					case <-sm.done:
+					case <-stop:
+						return
 					}
-					if !ored && m == nil {
-						return nil // results are ANDed and the current matcher doesn't match
+					if sm.err == nil {
+						rb.complete(seq, entry, sm.mm, true)
+						completed = true
 					}
-					if m != nil {
-						res.mm = append(res.mm, m)
-					}
-				}
-				if len(res.mm) > 0 {
-					rch <- res
+					return
 				}
+			}
 
+			var matched bool
+			err = entry.With(func(buf []byte) error {
+				mm := matchAll(newLineMatcher(q, options), buf)
+				matched = true
+				if sm != nil {
+					// buf is reused after return, keep a copy for other entries
+					sm.mm = copyMatches(mm)
+					close(sm.done)
+				}
+				// buf is valid only until With returns
+				rb.complete(seq, entry, mm, false)
+				completed = true
 				return nil
 			})
 			if err != nil {
-				ech <- err
+				if sm != nil && !matched {
+					// With failed before matching
+					sm.err = err
+					close(sm.done)
+				}
+				sendError(ech, stop, err)
 			}
-		}()
+		}(seq)
+		seq++
 
 		return nil
 	})
 	if err != nil {
-		ech <- err
+		sendError(ech, stop, err)
 	}
 
 	wg.Wait()
 }
 
-// matcher describes a compiled regular expression query
-type matcher struct {
-	// Compiled regexp.
-	rx *regexp.Regexp
-	// Result subexpression index.
-	rsi int
-}
-
-const (
-	// Result subexpression name.
-	rsn = "r"
-	// Query rx pattern.
-	queryPat = `(?:.*\n){0,%d}.*(?P<r>%s).*(\n|\z)(?:.*\n){0,%d}`
-)
-
-// newMatcher returns compiled matcher for the given query.
-func newMatcher(options *Options, query string) (*matcher, error) {
-	q := query
-	if !options.QueryIsRegexp {
-		q = regexp.QuoteMeta(q)
-	}
-	rx, err := regexp.Compile(fmt.Sprintf(queryPat, options.ContextBefore, q, options.ContextAfter))
-	if err != nil {
-		return nil, err
+// matchAll matches buf with lm and returns the results, or nil if buf doesn't match.
+func matchAll(lm *lineMatcher, buf []byte) []*Match {
+	if !lm.eval(buf) {
+		return nil
 	}
-
-	rsi := -1
-	for i, n := range rx.SubexpNames() {
-		if n == rsn {
-			rsi = i
+	// no queries to report lines for were provided, return the whole text
+	if len(lm.mrs) == 0 {
+		return []*Match{
+			{Text: buf, StartLine: 1, EndLine: bytes.Count(bytes.TrimSuffix(buf, []byte{'\n'}), []byte{'\n'}) + 1},
 		}
 	}
-	if rsi < 0 {
-		return nil, fmt.Errorf("invalid subexpressions: %s", rx)
+	mm := lm.match(buf)
+	if mm == nil {
+		// the expression matches without any matching lines, e.g. "foo OR NOT bar" in a log without both
+		mm = []*Match{}
 	}
+	return mm
+}
 
-	return &matcher{
-		rx:  rx,
-		rsi: rsi,
-	}, nil
+// sharedMatches holds matching results for contents referenced by several entries.
+type sharedMatches struct {
+	// closed when results are ready
+	done chan struct{}
+	mm   []*Match
+	err  error
+	// number of entries yet to get these results
+	refs int
 }
 
-// match performs matching against the given content.
-func (m *matcher) match(content []byte) (*Match, error) {
-	smi := m.rx.FindSubmatchIndex(content)
-	if smi == nil {
-		return nil, nil
+// sharedResults holds matching results by content ID.
+type sharedResults struct {
+	mu sync.Mutex // protects m
+	m  map[string]*sharedMatches
+}
+
+// get returns shared matching results for contents described by st.
+// It returns true if the caller is the first to request them and is
+// responsible for matching.
+func (r *sharedResults) get(st cache.EntryStat) (*sharedMatches, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sm, ok := r.m[st.ContentID]
+	if !ok {
+		sm = &sharedMatches{
+			done: make(chan struct{}),
+			refs: st.Refs,
+		}
+		r.m[st.ContentID] = sm
 	}
-	if len(smi) <= m.rsi {
-		return nil, fmt.Errorf("unexpected number of subexpressions %d in %v", len(smi), m)
+	if sm.refs--; sm.refs <= 0 {
+		delete(r.m, st.ContentID)
 	}
+	return sm, !ok
+}
 
-	res := &Match{
-		Text: content[smi[0]:smi[1]],
+// copyMatches returns a deep copy of mm.
+func copyMatches(mm []*Match) []*Match {
+	if mm == nil {
+		return nil
 	}
-	if m.rsi >= 0 {
-		res.ResultSubmatch = []int{smi[2*m.rsi] - smi[0], smi[2*m.rsi+1] - smi[0]}
+	res := make([]*Match, len(mm))
+	for i, m := range mm {
+		c := *m
+		c.Text = append([]byte(nil), m.Text...)
+		res[i] = &c
 	}
-
-	return res, nil
+	return res
 }
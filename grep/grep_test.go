@@ -0,0 +1,120 @@
+package grep
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmgk/fallout/cache"
+)
+
+// grepTestCache returns a memory cache holding n logs of varying length,
+// every third of them doesn't match "error".
+func grepTestCache(t *testing.T, n int) cache.Cacher {
+	c := cache.NewMemory()
+	for i := 0; i < n; i++ {
+		e, err := c.Entry(fmt.Sprintf("builder%d", i%3), fmt.Sprintf("devel/port%02d", i), time.Date(2022, 7, 1+i%28, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := "error"
+		if i%3 == 0 {
+			msg = "ok"
+		}
+		// longer logs take longer to match, so parallel jobs complete out of order
+		log := strings.Repeat("line\n", (n-i)*1000) + msg + "\n"
+		if err := e.Write([]byte(log)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// grepTestOrigins greps c and returns origins of matching logs in the reported order.
+func grepTestOrigins(t *testing.T, c cache.Cacher, options *Options, jobs int) []string {
+	t.Helper()
+	var res []string
+	gfn := func(entry cache.Entry, mm []*Match, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(mm) != 1 || string(mm[0].Text) != "error\n" {
+			t.Errorf("%s: unexpected matches", entry.Info().Origin)
+		}
+		res = append(res, entry.Info().Origin)
+		return nil
+	}
+	if err := New(c.Walker(nil)).Grep(options, []string{"error"}, gfn, jobs); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestGrepOrder(t *testing.T) {
+	c := grepTestCache(t, 60)
+
+	var walked []string
+	err := c.Walker(nil).Walk(func(entry cache.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, entry.Info().Origin)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, origin := range walked {
+		var i int
+		fmt.Sscanf(origin, "devel/port%d", &i)
+		if i%3 != 0 {
+			want = append(want, origin)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options Options
+		jobs    int
+		want    []string
+	}{
+		{"one job", Options{}, 1, want},
+		{"many jobs", Options{}, 8, want},
+		{"more jobs than logs", Options{}, 100, want},
+		{"max logs with one job", Options{MaxLogs: 5}, 1, want[:5]},
+		{"max logs with many jobs", Options{MaxLogs: 5}, 8, want[:5]},
+		{"max logs more than matching", Options{MaxLogs: 1000}, 8, want},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := grepTestOrigins(t, c, &tt.options, tt.jobs)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrepStop(t *testing.T) {
+	c := grepTestCache(t, 30)
+
+	var count int
+	gfn := func(entry cache.Entry, mm []*Match, err error) error {
+		if err != nil {
+			return err
+		}
+		if count++; count == 3 {
+			return Stop
+		}
+		return nil
+	}
+	if err := New(c.Walker(nil)).Grep(&Options{}, []string{"error"}, gfn, 8); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("got %d results, want 3", count)
+	}
+}
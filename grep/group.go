@@ -0,0 +1,118 @@
+package grep
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dmgk/fallout/cache"
+)
+
+// Group holds identical normalized matching lines found in several logs.
+type Group struct {
+	// Normalized matching line.
+	Line string
+	// Number of logs with this line.
+	Logs int
+	// Origins of logs with this line, sorted.
+	Origins []string
+}
+
+// GroupLines searches cached logs like Grep does and groups identical matching lines
+// across all matching logs after normalizing them with NormalizeLine. Each log is
+// counted once per group. Groups are in the descending order of log counts.
+func (g *Grepper) GroupLines(options *Options, queries []string, jobs int) ([]*Group, error) {
+	groups := map[string]*Group{}
+	origins := map[string]map[string]struct{}{}
+
+	gfn := func(entry cache.Entry, mm []*Match, err error) error {
+		if err != nil {
+			return err
+		}
+		origin := entry.Info().Origin
+
+		seen := map[string]bool{}
+		for _, m := range mm {
+			for _, ln := range m.matchingLines() {
+				line := NormalizeLine(string(ln))
+				if seen[line] {
+					continue
+				}
+				seen[line] = true
+
+				gr, ok := groups[line]
+				if !ok {
+					gr = &Group{Line: line}
+					groups[line] = gr
+					origins[line] = map[string]struct{}{}
+				}
+				gr.Logs++
+				origins[line][origin] = struct{}{}
+			}
+		}
+		return nil
+	}
+	if err := g.Grep(options, queries, gfn, jobs); err != nil {
+		return nil, err
+	}
+
+	res := make([]*Group, 0, len(groups))
+	for line, gr := range groups {
+		for o := range origins[line] {
+			gr.Origins = append(gr.Origins, o)
+		}
+		sort.Strings(gr.Origins)
+		res = append(res, gr)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Logs != res[j].Logs {
+			return res[i].Logs > res[j].Logs
+		}
+		return res[i].Line < res[j].Line
+	})
+	return res, nil
+}
+
+// matchingLines returns matching lines of m, without context.
+func (m *Match) matchingLines() [][]byte {
+	var res [][]byte
+	num, li := m.StartLine, 0
+	for pos := 0; pos < len(m.Text) && li < len(m.Lines); num++ {
+		end := len(m.Text)
+		if i := bytes.IndexByte(m.Text[pos:], '\n'); i >= 0 {
+			end = pos + i
+		}
+		if m.Lines[li] == num {
+			res = append(res, m.Text[pos:end])
+			li++
+		}
+		pos = end + 1
+	}
+	return res
+}
+
+var normalizers = []struct {
+	rx   *regexp.Regexp
+	repl string
+}{
+	// directories under /wrkdirs, only file names are kept
+	{regexp.MustCompile(`/wrkdirs/(?:[^\s/:'"()\[\]]+/)*`), ""},
+	// hex addresses
+	{regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`), "0x*"},
+	// line and column numbers after file names, e.g. foo.c:12:5
+	{regexp.MustCompile(`(\.\w+)(?::\d+){1,2}\b`), "$1"},
+	// versions, e.g. 1.2.3, 2.4_1 or 1.0,1
+	{regexp.MustCompile(`\b\d+(?:\.\d+)+(?:_\d+)?(?:,\d+)?\b`), "*"},
+	// whitespace runs
+	{regexp.MustCompile(`\s+`), " "},
+}
+
+// NormalizeLine strips log line parts that differ between otherwise identical errors:
+// paths under /wrkdirs, line and column numbers, versions and hex addresses.
+func NormalizeLine(line string) string {
+	for _, n := range normalizers {
+		line = n.rx.ReplaceAllString(line, n.repl)
+	}
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,583 @@
+package grep
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Logs are matched line by line, like grep(1) does. Each query is first
+// searched in the whole log, so logs and their parts without matches are
+// skipped quickly, and only lines containing query matches are matched
+// individually.
+
+// matcher describes a compiled query.
+type matcher struct {
+	// Compiled regexp, ^ and $ match at line boundaries.
+	rx *regexp.Regexp
+	// Multi-pattern plain text matcher, used instead of rx for plain text pattern lists.
+	ac *acMatcher
+	// Patterns of a pattern list, match locations hold the matching pattern index
+	// as the third element.
+	patterns []string
+	// Group index of each pattern in rx, for regexp pattern lists.
+	groups []int
+	// Only matches forming whole words are accepted.
+	word bool
+	// Only matches forming whole lines are accepted, rx takes care of this itself.
+	line bool
+}
+
+// newMatcher returns compiled matcher for the given query.
+func newMatcher(options *Options, query string) (*matcher, error) {
+	rx, err := regexp.Compile(matcherFlags(options) + wholeLine(options, matcherQuery(options, query)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %w", query, err)
+	}
+	return &matcher{
+		rx:   rx,
+		word: options.WholeWord,
+	}, nil
+}
+
+// newPatternMatcher returns compiled matcher matching any of the given patterns.
+// Plain text patterns, and regexp patterns without any special characters, are matched
+// with an Aho-Corasick automaton, unless they need case-insensitive matching beyond ASCII.
+func newPatternMatcher(options *Options, patterns []string) (*matcher, error) {
+	mr := &matcher{
+		patterns: patterns,
+		word:     options.WholeWord,
+	}
+
+	if (!options.QueryIsRegexp || isLiteral(patterns)) && (!options.IgnoreCase || isASCII(patterns)) {
+		mr.ac = newACMatcher(patterns, options.IgnoreCase)
+		mr.line = options.WholeLine
+		return mr, nil
+	}
+
+	// combine patterns into one alternation, each in its own group to tell which one matched
+	var sb strings.Builder
+	group := 1
+	for i, p := range patterns {
+		q := matcherQuery(options, p)
+		rx, err := regexp.Compile(q)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		if i > 0 {
+			sb.WriteByte('|')
+		}
+		sb.WriteString("(" + q + ")")
+		mr.groups = append(mr.groups, group)
+		group += 1 + rx.NumSubexp()
+	}
+	rx, err := regexp.Compile(matcherFlags(options) + wholeLine(options, sb.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid patterns: %w", err)
+	}
+	// the longest of the patterns matching at the same position wins, like with ac
+	rx.Longest()
+	mr.rx = rx
+	return mr, nil
+}
+
+func matcherQuery(options *Options, query string) string {
+	if !options.QueryIsRegexp {
+		return regexp.QuoteMeta(query)
+	}
+	return query
+}
+
+func matcherFlags(options *Options) string {
+	if options.IgnoreCase {
+		return "(?mi)"
+	}
+	return "(?m)"
+}
+
+func wholeLine(options *Options, query string) string {
+	if options.WholeLine {
+		return "^(?:" + query + ")$"
+	}
+	return query
+}
+
+func isLiteral(ss []string) bool {
+	for _, s := range ss {
+		if regexp.QuoteMeta(s) != s {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCII(ss []string) bool {
+	for _, s := range ss {
+		for i := 0; i < len(s); i++ {
+			if s[i] >= utf8.RuneSelf {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// find returns absolute offset of the first match in buf starting at from,
+// which is a line start, or -1 if there's none.
+func (mr *matcher) find(buf []byte, from int) int {
+	for from < len(buf) {
+		loc := mr.findFirst(buf, from)
+		if loc == nil {
+			return -1
+		}
+		if mr.accept(buf, loc) {
+			return loc[0]
+		}
+		// the first match isn't acceptable, check the rest of its line
+		ls := bytes.LastIndexByte(buf[:loc[0]], '\n') + 1
+		le := len(buf)
+		if i := bytes.IndexByte(buf[loc[0]:], '\n'); i >= 0 {
+			le = loc[0] + i
+		}
+		if locs := mr.findAll(buf[ls:le]); len(locs) > 0 {
+			return ls + locs[0][0]
+		}
+		from = le + 1
+	}
+	return -1
+}
+
+// findFirst returns the absolute location of the first match in buf starting at from,
+// or nil if there's none.
+func (mr *matcher) findFirst(buf []byte, from int) []int {
+	if mr.ac != nil {
+		return mr.ac.find(buf, from)
+	}
+	var loc []int
+	if mr.groups != nil {
+		loc = mr.rx.FindSubmatchIndex(buf[from:])
+	} else {
+		loc = mr.rx.FindIndex(buf[from:])
+	}
+	if loc == nil {
+		return nil
+	}
+	return mr.location(loc, from)
+}
+
+// findAll returns all match locations in line ln.
+func (mr *matcher) findAll(ln []byte) [][]int {
+	var locs [][]int
+	switch {
+	case mr.ac != nil:
+		for pos := 0; pos < len(ln); {
+			loc := mr.ac.find(ln, pos)
+			if loc == nil {
+				break
+			}
+			locs = append(locs, loc)
+			pos = loc[1]
+		}
+	case mr.groups != nil:
+		for _, loc := range mr.rx.FindAllSubmatchIndex(ln, -1) {
+			locs = append(locs, mr.location(loc, 0))
+		}
+	default:
+		locs = mr.rx.FindAllIndex(ln, -1)
+	}
+	if !mr.word && !mr.line {
+		return locs
+	}
+	res := locs[:0]
+	for _, loc := range locs {
+		if mr.accept(ln, loc) {
+			res = append(res, loc)
+		}
+	}
+	return res
+}
+
+// location converts regexp match location loc in buf[from:] into the absolute
+// match location, with the pattern index for pattern lists.
+func (mr *matcher) location(loc []int, from int) []int {
+	res := []int{from + loc[0], from + loc[1]}
+	for i, g := range mr.groups {
+		if loc[2*g] >= 0 {
+			res = append(res, i)
+			break
+		}
+	}
+	return res
+}
+
+// accept returns true if match location loc in buf forms a whole word or a whole line, if required.
+func (mr *matcher) accept(buf []byte, loc []int) bool {
+	if mr.word && !isWord(buf, loc[0], loc[1]) {
+		return false
+	}
+	if mr.line && !(loc[0] == 0 || buf[loc[0]-1] == '\n') || mr.line && !(loc[1] == len(buf) || buf[loc[1]] == '\n') {
+		return false
+	}
+	return true
+}
+
+// match returns true if mr matches anywhere in buf.
+func (mr *matcher) match(buf []byte) bool {
+	return mr.find(buf, 0) >= 0
+}
+
+// isWord returns true if buf[start:end] is neither preceded nor followed by a word character,
+// like grep -w does.
+func isWord(buf []byte, start, end int) bool {
+	if start > 0 {
+		if r, _ := utf8.DecodeLastRune(buf[:start]); isWordRune(r) {
+			return false
+		}
+	}
+	if end < len(buf) {
+		if r, _ := utf8.DecodeRune(buf[end:]); isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// newMatchers returns compiled matchers for the given queries.
+func newMatchers(options *Options, queries []string) ([]*matcher, error) {
+	var mrs []*matcher
+	for _, q := range queries {
+		m, err := newMatcher(options, q)
+		if err != nil {
+			return nil, err
+		}
+		mrs = append(mrs, m)
+	}
+	return mrs, nil
+}
+
+// lineSpan is a line position in the log.
+type lineSpan struct {
+	start int
+	// end of the line, not including line separator
+	end int
+	// line number, starting at 1
+	num int
+}
+
+// lineMatcher searches a log for lines matching queries and collects them with their context.
+type lineMatcher struct {
+	q       *query
+	mrs     []*matcher
+	after   int
+	maxLine int
+
+	buf []byte
+	// absolute offset of the next whole log match of each query, -1 if there are no more
+	next []int
+
+	// results
+	mm []*Match
+	// current block of merged matching lines and context, start is -1 if there's no block,
+	// block.num is the number of its first line
+	block      lineSpan
+	blockLast  int
+	blockSubs  [][]int
+	blockLines []int
+	blockMatch lineSpan
+	// patterns matching in the current line and in the current block
+	linePatterns  []string
+	blockPatterns []string
+	afterLeft     int
+	matchCount    int
+	// lines preceding the current one, not included in the block
+	ring *lineRing
+}
+
+func newLineMatcher(q *query, options *Options) *lineMatcher {
+	return &lineMatcher{
+		q:       q,
+		mrs:     q.lineMrs,
+		after:   options.ContextAfter,
+		maxLine: options.MaxCount,
+		next:    make([]int, len(q.lineMrs)),
+		ring:    newLineRing(options.ContextBefore),
+	}
+}
+
+// eval returns true if the query expression matches buf. It also finds
+// the first match of each line matcher, match needs to be called only after it.
+func (lm *lineMatcher) eval(buf []byte) bool {
+	lm.buf = buf
+	for i, mr := range lm.mrs {
+		lm.next[i] = lm.find(mr, 0)
+	}
+	if lm.q.root == nil {
+		return true
+	}
+	return lm.q.root.eval(func(i int) bool {
+		if li := lm.q.lines[i]; li >= 0 {
+			return lm.next[li] >= 0
+		}
+		return lm.q.mrs[i].match(buf)
+	})
+}
+
+// match returns all buf lines matching any of the line matchers, with their context.
+// Overlapping and adjacent context is merged, each Match holds one such block of lines.
+func (lm *lineMatcher) match(buf []byte) []*Match {
+	lm.buf = buf
+	lm.mm = nil
+	lm.block = lineSpan{-1, -1, 0}
+	lm.blockSubs = nil
+	lm.blockLines = nil
+	lm.blockPatterns = nil
+	lm.afterLeft = 0
+	lm.matchCount = 0
+	lm.ring.reset()
+
+	if lm.nextMatch() < 0 {
+		return nil
+	}
+
+	for pos, num := 0, 1; pos < len(buf); num++ {
+		ln := lineSpan{pos, len(buf), num}
+		if i := bytes.IndexByte(buf[pos:], '\n'); i >= 0 {
+			ln.end = pos + i
+		}
+		pos = ln.end + 1
+
+		if lm.maxLine > 0 && lm.matchCount >= lm.maxLine {
+			// only the trailing context is left
+			if lm.afterLeft == 0 {
+				break
+			}
+			lm.addContext(ln)
+			continue
+		}
+
+		if subs := lm.matchLine(ln, pos); subs != nil {
+			lm.addMatch(ln, subs)
+		} else {
+			lm.addContext(ln)
+		}
+
+		if lm.block.start < 0 && lm.nextMatch() < 0 {
+			break // no more matches and no open block
+		}
+	}
+	lm.closeBlock()
+
+	return lm.mm
+}
+
+// find returns absolute offset of the first match of mr in buf starting
+// at from, which is a line start, or -1 if there's none.
+func (lm *lineMatcher) find(mr *matcher, from int) int {
+	return mr.find(lm.buf, from)
+}
+
+// nextMatch returns offset of the nearest next query match, or -1 if there are none.
+func (lm *lineMatcher) nextMatch() int {
+	res := -1
+	for _, n := range lm.next {
+		if n >= 0 && (res < 0 || n < res) {
+			res = n
+		}
+	}
+	return res
+}
+
+// matchLine returns query match spans in line ln, relative to the line start,
+// or nil if it doesn't match. next is the next line start.
+func (lm *lineMatcher) matchLine(ln lineSpan, next int) [][]int {
+	var subs [][]int
+	var matched bool
+	lm.linePatterns = lm.linePatterns[:0]
+	for i, mr := range lm.mrs {
+		if lm.next[i] < 0 || lm.next[i] >= next {
+			continue // query doesn't match this line
+		}
+		// matches spanning several lines are ignored, they're not line matches
+		for _, loc := range mr.findAll(lm.buf[ln.start:ln.end]) {
+			matched = true
+			if loc[1] > loc[0] {
+				subs = append(subs, loc[:2])
+			}
+			if len(loc) > 2 {
+				lm.linePatterns = append(lm.linePatterns, mr.patterns[loc[2]])
+			}
+		}
+		lm.next[i] = lm.find(mr, next)
+	}
+	if !matched {
+		return nil
+	}
+	return mergeSpans(subs)
+}
+
+// addMatch adds matching line ln with match spans subs to the current block,
+// starting a new block if needed.
+func (lm *lineMatcher) addMatch(ln lineSpan, subs [][]int) {
+	if lm.block.start < 0 || lm.ring.overflowed {
+		// the line is too far from the current block
+		lm.closeBlock()
+		lm.block = ln
+		if first, ok := lm.ring.first(); ok {
+			lm.block.start, lm.block.num = first.start, first.num
+		}
+		lm.blockMatch = ln
+	}
+	lm.block.end = ln.end
+	lm.blockLast = ln.num
+	lm.blockLines = append(lm.blockLines, ln.num)
+	for _, p := range lm.linePatterns {
+		lm.blockPatterns = appendPattern(lm.blockPatterns, p)
+	}
+	for _, s := range subs {
+		lm.blockSubs = append(lm.blockSubs, []int{ln.start + s[0] - lm.block.start, ln.start + s[1] - lm.block.start})
+	}
+	lm.ring.reset()
+	lm.afterLeft = lm.after
+	lm.matchCount++
+}
+
+// addContext adds non-matching line ln to the current block as the trailing context,
+// or remembers it as the possible leading context of the next match.
+func (lm *lineMatcher) addContext(ln lineSpan) {
+	if lm.block.start >= 0 && lm.afterLeft > 0 {
+		lm.block.end = ln.end
+		lm.blockLast = ln.num
+		lm.afterLeft--
+		return
+	}
+	lm.ring.push(ln)
+	if lm.block.start >= 0 && lm.ring.overflowed {
+		// next match context can't reach the current block anymore
+		lm.closeBlock()
+	}
+}
+
+// closeBlock adds the current block to results.
+func (lm *lineMatcher) closeBlock() {
+	if lm.block.start < 0 {
+		return
+	}
+	end := lm.block.end
+	if end < len(lm.buf) {
+		end++ // include line separator
+	}
+	m := &Match{
+		Text:       lm.buf[lm.block.start:end],
+		Submatches: lm.blockSubs,
+		Line:       lm.blockMatch.num,
+		Offset:     lm.blockMatch.start,
+		TextOffset: lm.block.start,
+		StartLine:  lm.block.num,
+		EndLine:    lm.blockLast,
+		Lines:      lm.blockLines,
+		Patterns:   lm.blockPatterns,
+	}
+	if len(m.Submatches) > 0 {
+		m.ResultSubmatch = m.Submatches[0]
+	}
+	lm.mm = append(lm.mm, m)
+	lm.block = lineSpan{-1, -1, 0}
+	lm.blockSubs = nil
+	lm.blockLines = nil
+	lm.blockPatterns = nil
+}
+
+// appendPattern appends p to patterns, unless it's already there.
+func appendPattern(patterns []string, p string) []string {
+	for _, v := range patterns {
+		if v == p {
+			return patterns
+		}
+	}
+	return append(patterns, p)
+}
+
+// mergeSpans sorts spans by the start offset and merges overlapping ones.
+// It always returns a non-nil slice.
+func mergeSpans(spans [][]int) [][]int {
+	// spans are few, so insertion sort is fine
+	for i := 1; i < len(spans); i++ {
+		for j := i; j > 0 && spans[j][0] < spans[j-1][0]; j-- {
+			spans[j], spans[j-1] = spans[j-1], spans[j]
+		}
+	}
+	res := [][]int{}
+	for _, s := range spans {
+		if n := len(res); n > 0 && s[0] <= res[n-1][1] {
+			if s[1] > res[n-1][1] {
+				res[n-1][1] = s[1]
+			}
+			continue
+		}
+		res = append(res, []int{s[0], s[1]})
+	}
+	return res
+}
+
+// lineRing holds up to size most recent lines.
+// The storage grows as lines are pushed, so large sizes cost nothing for short logs.
+type lineRing struct {
+	size  int
+	lines []lineSpan
+	// index of the oldest line
+	head int
+	n    int
+	// more than size lines were pushed since the last reset
+	overflowed bool
+}
+
+func newLineRing(size int) *lineRing {
+	if size < 0 {
+		size = 0
+	}
+	return &lineRing{
+		size: size,
+	}
+}
+
+func (r *lineRing) reset() {
+	r.head = 0
+	r.n = 0
+	r.overflowed = false
+}
+
+func (r *lineRing) push(ln lineSpan) {
+	if r.size == 0 {
+		r.overflowed = true
+		return
+	}
+	if r.n < len(r.lines) {
+		r.lines[(r.head+r.n)%len(r.lines)] = ln
+		r.n++
+		return
+	}
+	if len(r.lines) < r.size {
+		// the ring never wrapped, so head is 0
+		r.lines = append(r.lines, ln)
+		r.n++
+		return
+	}
+	r.lines[r.head] = ln
+	r.head = (r.head + 1) % len(r.lines)
+	r.overflowed = true
+}
+
+// first returns the oldest line.
+func (r *lineRing) first() (lineSpan, bool) {
+	if r.n == 0 {
+		return lineSpan{}, false
+	}
+	return r.lines[r.head], true
+}
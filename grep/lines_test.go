@@ -0,0 +1,243 @@
+package grep
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testLog returns a log of n lines "line 1" to "line n", lines listed in errors
+// read "error at line i" instead.
+func testLog(n int, errors ...int) []byte {
+	isError := map[int]bool{}
+	for _, i := range errors {
+		isError[i] = true
+	}
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		if isError[i] {
+			fmt.Fprintf(&sb, "error at line %d\n", i)
+		} else {
+			fmt.Fprintf(&sb, "line %d\n", i)
+		}
+	}
+	return []byte(sb.String())
+}
+
+// matchLog matches buf and returns the results as "start-end [lines]" blocks.
+func matchLog(t *testing.T, buf []byte, options *Options, queries ...string) []string {
+	t.Helper()
+	q, err := newQuery(options, queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, m := range matchAll(newLineMatcher(q, options), buf) {
+		res = append(res, blockString(m))
+	}
+	return res
+}
+
+// blockString returns m as "start-end [lines]".
+func blockString(m *Match) string {
+	return fmt.Sprintf("%d-%d %v", m.StartLine, m.EndLine, m.Lines)
+}
+
+func TestContext(t *testing.T) {
+	buf := testLog(20, 3, 5, 12, 20)
+
+	tests := []struct {
+		name    string
+		options Options
+		want    []string
+	}{
+		{
+			name: "no context",
+			want: []string{"3-3 [3]", "5-5 [5]", "12-12 [12]", "20-20 [20]"},
+		},
+		{
+			name:    "after merges adjacent",
+			options: Options{ContextAfter: 1},
+			want:    []string{"3-6 [3 5]", "12-13 [12]", "20-20 [20]"},
+		},
+		{
+			name:    "after merges overlapping",
+			options: Options{ContextAfter: 2},
+			want:    []string{"3-7 [3 5]", "12-14 [12]", "20-20 [20]"},
+		},
+		{
+			name:    "before",
+			options: Options{ContextBefore: 2},
+			want:    []string{"1-5 [3 5]", "10-12 [12]", "18-20 [20]"},
+		},
+		{
+			name:    "before at log start",
+			options: Options{ContextBefore: 5},
+			want:    []string{"1-5 [3 5]", "7-12 [12]", "15-20 [20]"},
+		},
+		{
+			name:    "around",
+			options: Options{ContextBefore: 3, ContextAfter: 3},
+			want:    []string{"1-15 [3 5 12]", "17-20 [20]"},
+		},
+		{
+			name:    "context larger than log",
+			options: Options{ContextBefore: 100, ContextAfter: 100},
+			want:    []string{"1-20 [3 5 12 20]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchLog(t, buf, &tt.options, "error")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContextText(t *testing.T) {
+	buf := testLog(6, 3)
+	q, err := newQuery(&Options{}, []string{"error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := &Options{ContextBefore: 1, ContextAfter: 1}
+	mm := matchAll(newLineMatcher(q, options), buf)
+	if len(mm) != 1 {
+		t.Fatalf("got %d matches, want 1", len(mm))
+	}
+	want := "line 2\nerror at line 3\nline 4\n"
+	if got := string(mm[0].Text); got != want {
+		t.Errorf("got text %q, want %q", got, want)
+	}
+	if got := string(mm[0].Text[mm[0].ResultSubmatch[0]:mm[0].ResultSubmatch[1]]); got != "error" {
+		t.Errorf("got result submatch %q, want %q", got, "error")
+	}
+}
+
+func TestMaxCount(t *testing.T) {
+	buf := testLog(20, 3, 5, 12, 20)
+
+	tests := []struct {
+		name    string
+		options Options
+		want    []string
+	}{
+		{
+			name:    "one",
+			options: Options{MaxCount: 1},
+			want:    []string{"3-3 [3]"},
+		},
+		{
+			name:    "trailing context",
+			options: Options{MaxCount: 1, ContextAfter: 3},
+			want:    []string{"3-6 [3]"},
+		},
+		{
+			name:    "trailing context of the last counted line only",
+			options: Options{MaxCount: 2, ContextAfter: 2},
+			want:    []string{"3-7 [3 5]"},
+		},
+		{
+			name:    "more than matching",
+			options: Options{MaxCount: 10, ContextBefore: 1},
+			want:    []string{"2-5 [3 5]", "11-12 [12]", "19-20 [20]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchLog(t, buf, &tt.options, "error")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWholeWordAndLine(t *testing.T) {
+	buf := []byte("foo\nfoobar\nbar foo baz\nfoo_x\n(foo)\nFOO\n")
+
+	tests := []struct {
+		name    string
+		options Options
+		query   string
+		want    []string
+	}{
+		{
+			name:    "fixed word",
+			options: Options{WholeWord: true},
+			query:   "foo",
+			want:    []string{"1-1 [1]", "3-3 [3]", "5-5 [5]"},
+		},
+		{
+			name:    "regexp word",
+			options: Options{WholeWord: true, QueryIsRegexp: true},
+			query:   "fo+",
+			want:    []string{"1-1 [1]", "3-3 [3]", "5-5 [5]"},
+		},
+		{
+			name:    "regexp word retried after a non-word match",
+			options: Options{WholeWord: true, QueryIsRegexp: true},
+			query:   "ba[rz]",
+			want:    []string{"3-3 [3]"},
+		},
+		{
+			name:    "fixed line",
+			options: Options{WholeLine: true},
+			query:   "foo",
+			want:    []string{"1-1 [1]"},
+		},
+		{
+			name:    "regexp line",
+			options: Options{WholeLine: true, QueryIsRegexp: true},
+			query:   "foo.*",
+			want:    []string{"1-2 [1 2]", "4-4 [4]"},
+		},
+		{
+			name:    "fixed line ignoring case",
+			options: Options{WholeLine: true, IgnoreCase: true},
+			query:   "foo",
+			want:    []string{"1-1 [1]", "6-6 [6]"},
+		},
+		{
+			name:    "fixed string isn't a regexp",
+			options: Options{},
+			query:   "(foo)",
+			want:    []string{"5-5 [5]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchLog(t, buf, &tt.options, tt.query)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineRing(t *testing.T) {
+	r := newLineRing(3)
+	for i := 0; i < 5; i++ {
+		r.push(lineSpan{num: i + 1})
+	}
+	if ln, ok := r.first(); !ok || ln.num != 3 {
+		t.Errorf("got first line %d, %v, want 3", ln.num, ok)
+	}
+	if !r.overflowed {
+		t.Error("ring didn't overflow")
+	}
+	r.reset()
+	if _, ok := r.first(); ok {
+		t.Error("reset ring isn't empty")
+	}
+
+	// negative sizes are treated as 0
+	r = newLineRing(-1)
+	r.push(lineSpan{num: 1})
+	if _, ok := r.first(); ok {
+		t.Error("zero size ring isn't empty")
+	}
+}
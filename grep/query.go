@@ -0,0 +1,367 @@
+package grep
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Query expressions combine queries with AND, OR and NOT operators and parentheses, e.g.
+//
+//	(clang-16 OR clang-17) AND "error:" AND NOT "-Werror"
+//
+// NOT binds tighter than AND, which binds tighter than OR. Operators are case-sensitive.
+// Queries are bare words or double-quoted strings, with \" and \\ escapes inside quotes.
+// Queries are interpreted according to Options, as regexps unless Options.QueryIsRegexp
+// is false. An expression matches a log if it evaluates to true with each query being
+// true when it matches somewhere in the log. Lines matching queries that aren't negated
+// are reported.
+
+// node is a query expression tree node.
+type node struct {
+	op nodeOp
+	// query index, for opQuery nodes
+	query int
+	// operands, for other nodes
+	kids []*node
+}
+
+type nodeOp int
+
+const (
+	opQuery nodeOp = iota
+	opAnd
+	opOr
+	opNot
+)
+
+// eval evaluates the expression, found reports whether query i matches.
+func (n *node) eval(found func(i int) bool) bool {
+	switch n.op {
+	case opQuery:
+		return found(n.query)
+	case opAnd:
+		for _, k := range n.kids {
+			if !k.eval(found) {
+				return false
+			}
+		}
+		return true
+	case opOr:
+		for _, k := range n.kids {
+			if k.eval(found) {
+				return true
+			}
+		}
+		return false
+	case opNot:
+		return !n.kids[0].eval(found)
+	default:
+		panic(fmt.Sprintf("unknown query node op: %d", n.op))
+	}
+}
+
+// query is a compiled query expression.
+type query struct {
+	// expression tree, nil if any log matches
+	root *node
+	// matchers of all queries, indexed by node.query
+	mrs []*matcher
+	// lines[i] is the index of query i matcher in the line matchers, or -1 if it's negated
+	lines []int
+	// matchers of queries that aren't negated, their matching lines are reported
+	lineMrs []*matcher
+}
+
+// newQuery compiles positional queries, negated queries, the query expression and the pattern list
+// from options into one expression, they all need to match.
+func newQuery(options *Options, queries []string) (*query, error) {
+	var terms []string
+	var kids []*node
+
+	if len(queries) > 0 {
+		op := opAnd
+		if options.Ored {
+			op = opOr
+		}
+		n := &node{op: op}
+		for _, q := range queries {
+			n.kids = append(n.kids, &node{op: opQuery, query: len(terms)})
+			terms = append(terms, q)
+		}
+		kids = append(kids, n)
+	}
+	for _, q := range options.Negated {
+		kids = append(kids, &node{op: opNot, kids: []*node{{op: opQuery, query: len(terms)}}})
+		terms = append(terms, q)
+	}
+	if options.Expression != "" {
+		p := &parser{s: options.Expression, terms: terms}
+		n, err := p.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid query expression %q: %w", options.Expression, err)
+		}
+		terms = p.terms
+		kids = append(kids, n)
+	}
+
+	var patterns []string
+	for _, p := range options.Patterns {
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	if len(options.Patterns) > 0 && len(patterns) == 0 {
+		return nil, errors.New("pattern list has no patterns")
+	}
+	if len(patterns) > 0 {
+		// the pattern list is matched as a single query
+		kids = append(kids, &node{op: opQuery, query: len(terms)})
+	}
+
+	q := &query{}
+	switch len(kids) {
+	case 0:
+	case 1:
+		q.root = kids[0]
+	default:
+		q.root = &node{op: opAnd, kids: kids}
+	}
+
+	mrs, err := newMatchers(options, terms)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) > 0 {
+		mr, err := newPatternMatcher(options, patterns)
+		if err != nil {
+			return nil, err
+		}
+		mrs = append(mrs, mr)
+	}
+	q.mrs = mrs
+	q.lines = make([]int, len(mrs))
+	for i := range q.lines {
+		q.lines[i] = -1
+	}
+	if q.root != nil {
+		q.root.positive(false, func(i int) {
+			if q.lines[i] < 0 {
+				q.lines[i] = len(q.lineMrs)
+				q.lineMrs = append(q.lineMrs, q.mrs[i])
+			}
+		})
+	}
+	return q, nil
+}
+
+// HasLineQueries returns true if queries and options have any queries that aren't negated,
+// so matching lines can be reported. Otherwise Grep returns the whole text of matching logs.
+func HasLineQueries(options *Options, queries []string) (bool, error) {
+	q, err := newQuery(options, queries)
+	if err != nil {
+		return false, err
+	}
+	return len(q.lineMrs) > 0, nil
+}
+
+// positive calls fn for each query that isn't negated, negated is true if n itself is negated.
+func (n *node) positive(negated bool, fn func(i int)) {
+	switch n.op {
+	case opQuery:
+		if !negated {
+			fn(n.query)
+		}
+	case opNot:
+		n.kids[0].positive(!negated, fn)
+	default:
+		for _, k := range n.kids {
+			k.positive(negated, fn)
+		}
+	}
+}
+
+// parser is a recursive descent query expression parser:
+//
+//	or      = and { "OR" and }
+//	and     = not { "AND" not }
+//	not     = "NOT" not | primary
+//	primary = "(" or ")" | query
+type parser struct {
+	s   string
+	pos int
+	// current token
+	tok token
+	// queries, parsed ones are appended
+	terms []string
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokQuery
+	tokAnd
+	tokOr
+	tokNot
+	tokLparen
+	tokRparen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (p *parser) parse() (*node, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	return n, nil
+}
+
+func (p *parser) parseOr() (*node, error) {
+	return p.parseBinary(opOr, tokOr, p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*node, error) {
+	return p.parseBinary(opAnd, tokAnd, p.parseNot)
+}
+
+// parseBinary parses operands separated by the operator token kind.
+func (p *parser) parseBinary(op nodeOp, kind tokenKind, operand func() (*node, error)) (*node, error) {
+	n, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != kind {
+		return n, nil
+	}
+	res := &node{op: op, kids: []*node{n}}
+	for p.tok.kind == kind {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		res.kids = append(res.kids, n)
+	}
+	return res, nil
+}
+
+func (p *parser) parseNot() (*node, error) {
+	if p.tok.kind != tokNot {
+		return p.parsePrimary()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	n, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return &node{op: opNot, kids: []*node{n}}, nil
+}
+
+func (p *parser) parsePrimary() (*node, error) {
+	switch p.tok.kind {
+	case tokLparen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRparen {
+			return nil, p.errorf("missing )")
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case tokQuery:
+		n := &node{op: opQuery, query: len(p.terms)}
+		p.terms = append(p.terms, p.tok.text)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case tokEOF:
+		return nil, p.errorf("unexpected end of expression")
+	default:
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+}
+
+// next scans the next token.
+func (p *parser) next() error {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+	p.tok = token{pos: p.pos}
+	if p.pos >= len(p.s) {
+		p.tok.kind = tokEOF
+		return nil
+	}
+
+	switch c := p.s[p.pos]; c {
+	case '(':
+		p.tok.kind, p.tok.text = tokLparen, "("
+		p.pos++
+	case ')':
+		p.tok.kind, p.tok.text = tokRparen, ")"
+		p.pos++
+	case '"':
+		var sb strings.Builder
+		p.pos++
+		for {
+			if p.pos >= len(p.s) {
+				return p.errorf("unterminated quoted query")
+			}
+			c := p.s[p.pos]
+			p.pos++
+			if c == '"' {
+				break
+			}
+			if c == '\\' && p.pos < len(p.s) && (p.s[p.pos] == '"' || p.s[p.pos] == '\\') {
+				c = p.s[p.pos]
+				p.pos++
+			}
+			sb.WriteByte(c)
+		}
+		p.tok.kind, p.tok.text = tokQuery, sb.String()
+	default:
+		start := p.pos
+		for p.pos < len(p.s) && !unicode.IsSpace(rune(p.s[p.pos])) && !strings.ContainsRune(`()"`, rune(p.s[p.pos])) {
+			p.pos++
+		}
+		p.tok.text = p.s[start:p.pos]
+		switch p.tok.text {
+		case "AND":
+			p.tok.kind = tokAnd
+		case "OR":
+			p.tok.kind = tokOr
+		case "NOT":
+			p.tok.kind = tokNot
+		default:
+			p.tok.kind = tokQuery
+		}
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
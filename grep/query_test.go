@@ -0,0 +1,165 @@
+package grep
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	buf := []byte("configure\nclang-16: error: foo\nwarning: bar\n-Werror\ndone\n")
+
+	tests := []struct {
+		name    string
+		options Options
+		queries []string
+		// expected "start-end [lines]" blocks, nil if the log doesn't match
+		want []string
+	}{
+		{
+			name:    "and",
+			queries: []string{"error", "bar"},
+			want:    []string{"2-4 [2 3 4]"},
+		},
+		{
+			name:    "and not matching",
+			queries: []string{"error", "baz"},
+			want:    nil,
+		},
+		{
+			name:    "or",
+			options: Options{Ored: true},
+			queries: []string{"baz", "bar"},
+			want:    []string{"3-3 [3]"},
+		},
+		{
+			name:    "negated skips log",
+			options: Options{Negated: []string{"Werror"}},
+			queries: []string{"error"},
+			want:    nil,
+		},
+		{
+			name:    "negated not matching",
+			options: Options{Negated: []string{"fatal"}},
+			queries: []string{"warning"},
+			want:    []string{"3-3 [3]"},
+		},
+		{
+			name:    "negated only returns whole text",
+			options: Options{Negated: []string{"fatal"}},
+			want:    []string{"1-5 []"},
+		},
+		{
+			name:    "negated only skips log",
+			options: Options{Negated: []string{"fatal", "done"}},
+			want:    nil,
+		},
+		{
+			name:    "expression",
+			options: Options{Expression: `(clang-15 OR clang-16) AND "error:" AND NOT fatal`},
+			want:    []string{"2-2 [2]"},
+		},
+		{
+			name:    "expression NOT binds tighter than AND",
+			options: Options{Expression: `NOT fatal AND bar`},
+			want:    []string{"3-3 [3]"},
+		},
+		{
+			name:    "expression AND binds tighter than OR",
+			options: Options{Expression: `fatal AND bar OR done`},
+			// lines of all queries that aren't negated are reported
+			want: []string{"3-3 [3]", "5-5 [5]"},
+		},
+		{
+			name:    "expression negated lines aren't reported",
+			options: Options{Expression: `done AND NOT (fatal OR "panic:")`},
+			want:    []string{"5-5 [5]"},
+		},
+		{
+			name:    "expression double negation is reported",
+			options: Options{Expression: `NOT NOT bar`},
+			want:    []string{"3-3 [3]"},
+		},
+		{
+			name:    "expression matching without lines",
+			options: Options{Expression: `fatal OR NOT panic`},
+			want:    []string{},
+		},
+		{
+			name:    "expression and queries",
+			options: Options{Expression: `NOT done`},
+			queries: []string{"bar"},
+			want:    nil,
+		},
+		{
+			name:    "patterns",
+			options: Options{Patterns: []string{"", "fatal", "bar"}},
+			queries: []string{"configure"},
+			want:    []string{"1-1 [1]", "3-3 [3]"},
+		},
+		{
+			name:    "patterns not matching",
+			options: Options{Patterns: []string{"fatal", "panic"}},
+			queries: []string{"configure"},
+			want:    nil,
+		},
+		{
+			name:    "regexp ignoring case",
+			options: Options{QueryIsRegexp: true, IgnoreCase: true, Negated: []string{"^fatal"}},
+			queries: []string{"^-w[a-z]+$"},
+			want:    []string{"4-4 [4]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := newQuery(&tt.options, tt.queries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mm := matchAll(newLineMatcher(q, &tt.options), buf)
+			var got []string
+			if mm != nil {
+				got = []string{}
+				for _, m := range mm {
+					got = append(got, blockString(m))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryPatterns(t *testing.T) {
+	buf := []byte("a bar\nfoo\nbar foo\n")
+	options := &Options{Patterns: []string{"baz", "foo", "bar"}}
+	q, err := newQuery(options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := matchAll(newLineMatcher(q, options), buf)
+	want := []string{"bar", "foo"}
+	if got := MatchedPatterns(mm); !reflect.DeepEqual(got, want) {
+		t.Errorf("got patterns %q, want %q", got, want)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"unbalanced parentheses", Options{Expression: `(foo OR bar`}},
+		{"missing operand", Options{Expression: `foo AND`}},
+		{"unterminated quote", Options{Expression: `"foo`}},
+		{"empty pattern list", Options{Patterns: []string{"", ""}}},
+		{"invalid regexp", Options{QueryIsRegexp: true, Expression: `"fo(o"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newQuery(&tt.options, nil); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package grep
+
+import (
+	"sync"
+
+	"github.com/dmgk/fallout/cache"
+)
+
+// reorderBuffer delivers results of parallel matching in the walk order.
+// The result that is next in order is delivered directly by the worker that produced it,
+// results that are ahead are copied and kept until their turn, so workers never wait
+// for each other. At most window results may be ahead, see wait.
+type reorderBuffer struct {
+	rch    chan *grepResult
+	stop   chan struct{}
+	window int
+
+	mu sync.Mutex // protects fields below
+	// sequence number of the next result to deliver
+	next int
+	// results waiting for delivery by sequence number, nil if the entry didn't match
+	pending map[int]*grepResult
+	// a worker is delivering results
+	busy bool
+	// closed and replaced when next advances
+	advanced chan struct{}
+}
+
+func newReorderBuffer(rch chan *grepResult, stop chan struct{}, window int) *reorderBuffer {
+	return &reorderBuffer{
+		rch:      rch,
+		stop:     stop,
+		window:   window,
+		pending:  map[int]*grepResult{},
+		advanced: make(chan struct{}),
+	}
+}
+
+// wait blocks until the result with sequence number seq is within the window,
+// so results kept out of order are bounded. It returns false if grepping was stopped.
+func (b *reorderBuffer) wait(seq int) bool {
+	for {
+		b.mu.Lock()
+		if seq-b.next < b.window {
+			b.mu.Unlock()
+			return true
+		}
+		advanced := b.advanced
+		b.mu.Unlock()
+
+		select {
+		case <-advanced:
+		case <-b.stop:
+			return false
+		}
+	}
+}
+
+// complete records matching results mm of entry with sequence number seq.
+// It has to be called exactly once for each sequence number, with nil mm if the entry
+// didn't match or couldn't be matched. If detached is false, mm may reference
+// entry contents valid only until complete returns.
+func (b *reorderBuffer) complete(seq int, entry cache.Entry, mm []*Match, detached bool) {
+	select {
+	case <-b.stop:
+		return // nothing is delivered after grepping was stopped
+	default:
+	}
+
+	b.mu.Lock()
+	if seq != b.next || b.busy {
+		if mm != nil && !detached {
+			mm = copyMatches(mm)
+		}
+		var r *grepResult
+		if mm != nil {
+			r = &grepResult{entry: entry, mm: mm}
+		}
+		b.pending[seq] = r
+		b.mu.Unlock()
+		return
+	}
+
+	b.busy = true
+	b.mu.Unlock()
+	if mm != nil && !sendResult(b.rch, b.stop, entry, mm) {
+		return // grepping was stopped, keep busy so nothing else is sent
+	}
+
+	b.mu.Lock()
+	b.next++
+	for {
+		r, ok := b.pending[b.next]
+		if !ok {
+			break
+		}
+		delete(b.pending, b.next)
+		if r != nil {
+			b.mu.Unlock()
+			if !sendResult(b.rch, b.stop, r.entry, r.mm) {
+				return
+			}
+			b.mu.Lock()
+		}
+		b.next++
+	}
+	b.busy = false
+	close(b.advanced)
+	b.advanced = make(chan struct{})
+	b.mu.Unlock()
+}
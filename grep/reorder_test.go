@@ -0,0 +1,85 @@
+package grep
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dmgk/fallout/cache"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	var entries []cache.Entry
+	err := grepTestCache(t, 6).Walker(nil).Walk(func(entry cache.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rch := make(chan *grepResult)
+	stop := make(chan struct{})
+	defer close(stop)
+	rb := newReorderBuffer(rch, stop, 4)
+
+	var got []int
+	done := make(chan struct{})
+	go func() {
+		for r := range rch {
+			got = append(got, r.mm[0].Line)
+			close(r.done)
+		}
+		close(done)
+	}()
+
+	// results are completed in reverse order, 2 didn't match
+	for seq := len(entries) - 1; seq >= 0; seq-- {
+		var mm []*Match
+		if seq != 2 {
+			mm = []*Match{{Line: seq}}
+		}
+		rb.complete(seq, entries[seq], mm, false)
+	}
+	close(rch)
+	<-done
+
+	want := []int{0, 1, 3, 4, 5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReorderBufferWait(t *testing.T) {
+	rch := make(chan *grepResult)
+	stop := make(chan struct{})
+	rb := newReorderBuffer(rch, stop, 2)
+
+	if !rb.wait(0) || !rb.wait(1) {
+		t.Fatal("wait blocked within the window")
+	}
+	waited := make(chan bool)
+	go func() {
+		waited <- rb.wait(2)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("wait didn't block outside the window")
+	default:
+	}
+	// a non-matching result advances the window
+	rb.complete(0, nil, nil, false)
+	if !<-waited {
+		t.Error("wait returned false")
+	}
+
+	go func() {
+		waited <- rb.wait(10)
+	}()
+	close(stop)
+	if <-waited {
+		t.Error("wait returned true after stop")
+	}
+}
@@ -0,0 +1,90 @@
+package grep
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dmgk/fallout/cache"
+)
+
+// Summary holds numbers of matching logs broken down by builder, category and day.
+type Summary struct {
+	// Number of matching logs.
+	Logs int
+	// Number of matching lines in all logs.
+	Lines int
+	// Matching logs by builder, by category and by day, in UTC.
+	// Builders and categories are in the descending order of counts, days are in the ascending order.
+	Builders   []Count
+	Categories []Count
+	Days       []Count
+	// Matching logs by Options.Patterns, in the descending order of counts.
+	Patterns []Count
+}
+
+// Count is a number of matching logs for the given builder, category or day.
+type Count struct {
+	Name string
+	Logs int
+}
+
+// Summarize searches cached logs like Grep does and returns the summary of matching logs.
+func (g *Grepper) Summarize(options *Options, queries []string, jobs int) (*Summary, error) {
+	res := &Summary{}
+	builders := map[string]int{}
+	categories := map[string]int{}
+	days := map[string]int{}
+	patterns := map[string]int{}
+
+	gfn := func(entry cache.Entry, mm []*Match, err error) error {
+		if err != nil {
+			return err
+		}
+		inf := entry.Info()
+		category, _, _ := strings.Cut(inf.Origin, "/")
+
+		res.Logs++
+		res.Lines += CountLines(mm)
+		builders[inf.Builder]++
+		categories[category]++
+		days[inf.Timestamp.UTC().Format("2006-01-02")]++
+		for _, p := range MatchedPatterns(mm) {
+			patterns[p]++
+		}
+		return nil
+	}
+	if err := g.Grep(options, queries, gfn, jobs); err != nil {
+		return nil, err
+	}
+
+	res.Builders = sortedCounts(builders, true)
+	res.Categories = sortedCounts(categories, true)
+	res.Days = sortedCounts(days, false)
+	res.Patterns = sortedCounts(patterns, true)
+	return res, nil
+}
+
+// CountLines returns the number of matching lines in mm.
+func CountLines(mm []*Match) int {
+	var n int
+	for _, m := range mm {
+		n += len(m.Lines)
+	}
+	return n
+}
+
+// sortedCounts returns counts from m sorted by name or, if byLogs is true,
+// in the descending order of counts.
+func sortedCounts(m map[string]int, byLogs bool) []Count {
+	res := make([]Count, 0, len(m))
+	for k, v := range m {
+		res = append(res, Count{Name: k, Logs: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if byLogs && res[i].Logs != res[j].Logs {
+			return res[i].Logs > res[j].Logs
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
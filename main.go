@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -14,7 +15,7 @@ import (
 )
 
 var usageTmpl = template.Must(template.New("usage").Parse(`
-usage: {{.progname}} [-hV] [-M mode] [-G colors] command [options]
+usage: {{.progname}} [-hV] [-M mode] [-G colors] [-d dir] [-P profile] command [options]
 
 Download and search fallout logs.
 
@@ -24,6 +25,8 @@ Options:
   -M mode         color mode [auto|never|always] (default: {{.colorMode}})
   -G colors       set colors (default: "{{.colors}}")
                   the order is query,match,path,separator; see ls(1) for color codes
+  -d dir          use this cache directory (default: {{.cacheDir}})
+  -P profile      use this named profile, profiles are defined in {{.profilesPath}}
 
 Commands (pass -h for command help):{{range .cmds}}
   {{.Name | printf "%-15s"}} {{.Summary}}{{end}}
@@ -49,10 +52,12 @@ const (
 
 func showUsage() {
 	err := usageTmpl.Execute(os.Stdout, map[string]any{
-		"progname":  progname,
-		"colorMode": colorMode,
-		"colors":    colors,
-		"cmds":      cmds,
+		"progname":     progname,
+		"colorMode":    colorMode,
+		"colors":       colors,
+		"cacheDir":     defaultCacheDir(),
+		"profilesPath": profilesPath(),
+		"cmds":         cmds,
 	})
 	if err != nil {
 		panic(fmt.Sprintf("error executing template %s: %v", usageTmpl.Name(), err))
@@ -80,20 +85,30 @@ var cmds = []*command{
 	&fetchCmd,
 	&grepCmd,
 	&cleanCmd,
+	&restoreCmd,
+	&pinCmd,
+	&unpinCmd,
 	&statsCmd,
+	&fsckCmd,
+	&cacheCmd,
 }
 
 func main() {
 	if v, ok := os.LookupEnv("FALLOUT_COLORS"); ok && v != "" {
 		colors = v
 	}
+	envCacheDir := os.Getenv("FALLOUT_CACHE")
+	if v, ok := os.LookupEnv("FALLOUT_PROFILE"); ok && v != "" {
+		profileName = v
+	}
 
-	opts, err := getopt.NewArgv("hVM:G:", argsWithDefaults(os.Args, "FALLOUT_OPTS"))
+	opts, err := getopt.NewArgv("hVM:G:d:P:", argsWithDefaults(os.Args, "FALLOUT_OPTS"))
 	if err != nil {
 		panic(fmt.Sprintf("error creating options parser: %s", err))
 	}
 	progname = opts.ProgramName()
 
+	var profileSelected bool
 	for opts.Scan() {
 		opt, err := opts.Option()
 		if err != nil {
@@ -116,10 +131,19 @@ func main() {
 			}
 		case 'G':
 			colors = opt.String()
+		case 'd':
+			cacheDir = opt.String()
+		case 'P':
+			profileName = opt.String()
+			profileSelected = true
 		default:
 			panic("unhandled option: -" + string(opt.Opt))
 		}
 	}
+	// cache of the profile selected with -P takes precedence over FALLOUT_CACHE
+	if cacheDir == "" && !profileSelected {
+		cacheDir = envCacheDir
+	}
 
 	args := opts.Args()
 	if len(args) == 0 {
@@ -150,6 +174,59 @@ func argsWithDefaults(argv []string, env string) []string {
 	return append([]string{argv[0]}, args...)
 }
 
+// expandLongOptions replaces long options in argv with their short equivalents
+// from long, so they can be handled by getopt: "--name" becomes "-n" and
+// "--name=value" becomes "-nvalue". Expansion stops at the first operand or "--".
+func expandLongOptions(argv []string, optstring string, long map[string]byte) []string {
+	hasArg := func(opt byte) bool {
+		i := strings.IndexByte(optstring, opt)
+		return i >= 0 && i < len(optstring)-1 && optstring[i+1] == ':'
+	}
+
+	res := []string{argv[0]}
+	for i := 1; i < len(argv); i++ {
+		arg := argv[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			return append(res, argv[i:]...)
+		}
+
+		var opt byte
+		if arg[1] == '-' {
+			name, value, ok := strings.Cut(arg[2:], "=")
+			if opt = long[name]; opt == 0 {
+				errExit("unknown option: --%s", name)
+			}
+			if ok {
+				if !hasArg(opt) {
+					errExit("option --%s doesn't allow an argument", name)
+				}
+				res = append(res, "-"+string(opt)+value)
+				continue
+			}
+			res = append(res, "-"+string(opt))
+		} else {
+			res = append(res, arg)
+			// find an option requiring argument in the cluster, e.g. -lA1
+			for j := 1; j < len(arg); j++ {
+				if hasArg(arg[j]) {
+					if j < len(arg)-1 {
+						opt = 0 // argument is in the same argv element
+					} else {
+						opt = arg[j]
+					}
+					break
+				}
+			}
+		}
+		if opt != 0 && hasArg(opt) && i+1 < len(argv) {
+			// option argument is in the next argv element
+			i++
+			res = append(res, argv[i])
+		}
+	}
+	return res
+}
+
 func splitOptions(s string) []string {
 	return strings.FieldsFunc(s, func(r rune) bool {
 		return unicode.IsSpace(r) || r == ','
@@ -174,6 +251,26 @@ func parseDateTime(s string) (time.Time, error) {
 	return zero, errors.New("invalid date or datetime")
 }
 
+// parseSize parses size with an optional K, M, G or T suffix, e.g. "2G" or "500MB".
+func parseSize(s string) (int64, error) {
+	const suffixes = "KMGT"
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if n := len(v); n > 0 {
+		if i := strings.IndexByte(suffixes, v[n-1]); i >= 0 {
+			v = strings.TrimSpace(v[:n-1])
+			for ; i >= 0; i-- {
+				mult *= 1000
+			}
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
 func formatSize(size int64) string {
 	const suffixes = "KMG"
 	if size < 1000 {
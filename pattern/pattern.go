@@ -0,0 +1,145 @@
+// Package pattern implements filter term matching shared by cache walkers and log fetchers.
+//
+// Filter term syntax:
+//
+//	text      plain text, matched partially or exactly depending on the list mode
+//	glob*     shell glob, matched against the whole value, see path.Match
+//	~regex    regular expression, matched anywhere in the value unless anchored
+//	!term     negated term, values matching it are excluded
+//
+// In Flavored mode values are port origins with an optional @flavor suffix,
+// terms without a flavor match all flavors of the port.
+package pattern
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Mode is the plain text terms matching mode.
+type Mode int
+
+const (
+	// Plain text terms match any part of the value.
+	Partial Mode = iota
+	// Plain text terms match only the whole value.
+	Exact
+	// Like Exact, but terms without the flavor separator match values regardless of their flavor.
+	Flavored
+)
+
+const (
+	negatePrefix = "!"
+	regexpPrefix = "~"
+	globChars    = "*?["
+	// FlavorSeparator separates port origin and flavor, e.g. devel/py-foo@py39.
+	FlavorSeparator = "@"
+)
+
+// List is a compiled list of filter terms.
+type List struct {
+	allowed  []matcher
+	excluded []matcher
+}
+
+// matcher matches a single filter term.
+type matcher func(value string) bool
+
+// Compile returns compiled terms list. Empty or nil terms produce a list that allows everything.
+func Compile(terms []string, mode Mode) (*List, error) {
+	l := &List{}
+	for _, t := range terms {
+		negated := strings.HasPrefix(t, negatePrefix)
+		if negated {
+			t = t[len(negatePrefix):]
+		}
+		m, err := compileTerm(t, mode)
+		if err != nil {
+			return nil, err
+		}
+		if negated {
+			l.excluded = append(l.excluded, m)
+		} else {
+			l.allowed = append(l.allowed, m)
+		}
+	}
+	return l, nil
+}
+
+// MustCompile is like Compile but panics if terms can't be compiled.
+func MustCompile(terms []string, mode Mode) *List {
+	l, err := Compile(terms, mode)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+func compileTerm(t string, mode Mode) (matcher, error) {
+	if mode == Flavored {
+		m, err := compileTerm(t, Exact)
+		if err != nil || strings.Contains(t, FlavorSeparator) {
+			return m, err
+		}
+		return func(value string) bool {
+			return m(StripFlavor(value))
+		}, nil
+	}
+
+	switch {
+	case strings.HasPrefix(t, regexpPrefix):
+		rx, err := regexp.Compile(t[len(regexpPrefix):])
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter regexp %q: %w", t, err)
+		}
+		return rx.MatchString, nil
+	case strings.ContainsAny(t, globChars):
+		if _, err := path.Match(t, ""); err != nil {
+			return nil, fmt.Errorf("invalid filter glob %q: %w", t, err)
+		}
+		return func(value string) bool {
+			ok, _ := path.Match(t, value)
+			return ok
+		}, nil
+	case mode == Exact:
+		return func(value string) bool {
+			return value == t
+		}, nil
+	default:
+		return func(value string) bool {
+			return strings.Contains(value, t)
+		}, nil
+	}
+}
+
+// Match returns true if value matches at least one of the terms, or if there
+// are no such terms, and doesn't match any of the negated terms.
+func (l *List) Match(value string) bool {
+	if l == nil {
+		return true
+	}
+	for _, m := range l.excluded {
+		if m(value) {
+			return false
+		}
+	}
+	if len(l.allowed) == 0 {
+		return true
+	}
+	for _, m := range l.allowed {
+		if m(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripFlavor returns port origin without flavor.
+func StripFlavor(origin string) string {
+	if i := strings.Index(origin, FlavorSeparator); i >= 0 {
+		return origin[:i]
+	}
+	return origin
+}
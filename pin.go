@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+
+	"github.com/dmgk/fallout/cache"
+	"github.com/dmgk/getopt"
+)
+
+var pinUsageTmpl = template.Must(template.New("usage-pin").Parse(`
+usage: {{.progname}} {{.cmd}} [-ht] [-b builder[,builder]] [-c category[,category]] [-o origin[,origin]] [-n name[,name]] [-s since] [-e before] [log ...]
+
+{{.description}} Logs are given by their paths, as printed by grep, or selected by filters.
+Without arguments, list pinned logs.
+
+Options:
+  -h              show help and exit
+  -t              select only the latest log for each builder and origin, also --latest
+  -b builder,...  select only logs from these builders
+  -c category,... select only logs for these categories
+  -o origin,...   select only logs for these origins, use origin@flavor for a single flavor
+  -n name,...     select only logs for these port names
+                  values can be globs, e.g. -o 'devel/py-*', or regexps prefixed with ~, e.g. -b '~^main-.*-default$'
+                  prefix a value with ! to exclude it, e.g. -b '!i386'
+  -s since        select only logs since this date or date-time, in RFC-3339 format
+  -e before       select only logs before this date or date-time, in RFC-3339 format
+`[1:]))
+
+var pinCmd = command{
+	Name:    "pin",
+	Summary: "protect logs from cleaning",
+	run:     runPin,
+}
+
+var unpinCmd = command{
+	Name:    "unpin",
+	Summary: "remove logs protection from cleaning",
+	run:     runUnpin,
+}
+
+func showPinUsage(pin bool) {
+	cmd := "unpin"
+	description := "Remove logs protection from cleaning."
+	if pin {
+		cmd = "pin"
+		description = "Protect logs from cleaning, pinned logs are never removed by clean."
+	}
+	err := pinUsageTmpl.Execute(os.Stdout, map[string]any{
+		"progname":    progname,
+		"cmd":         cmd,
+		"description": description,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("error executing template %s: %v", pinUsageTmpl.Name(), err))
+	}
+}
+
+func runPin(args []string) int {
+	return pinEntries(args, true)
+}
+
+func runUnpin(args []string) int {
+	return pinEntries(args, false)
+}
+
+// pinEntries pins or unpins logs given by args.
+func pinEntries(args []string, pin bool) int {
+	const optstring = "htb:c:o:n:s:e:"
+	opts, err := getopt.NewArgv(optstring, expandLongOptions(args, optstring, map[string]byte{
+		"latest": 't',
+	}))
+	if err != nil {
+		panic(fmt.Sprintf("error creating options parser: %s", err))
+	}
+
+	filter := &cache.Filter{}
+	var filtered bool
+	for opts.Scan() {
+		opt, err := opts.Option()
+		if err != nil {
+			errExit(err.Error())
+		}
+
+		switch opt.Opt {
+		case 'h':
+			showPinUsage(pin)
+			os.Exit(0)
+		case 't':
+			filter.Latest = cache.LatestPerBuilder
+		case 'b':
+			filter.Builders = splitOptions(opt.String())
+		case 'c':
+			filter.Categories = splitOptions(opt.String())
+		case 'o':
+			filter.Origins = splitOptions(opt.String())
+		case 'n':
+			filter.Names = splitOptions(opt.String())
+		case 's':
+			t, err := parseDateTime(opt.String())
+			if err != nil {
+				errExit("-s: %s", err)
+			}
+			filter.Since = t
+		case 'e':
+			t, err := parseDateTime(opt.String())
+			if err != nil {
+				errExit("-e: %s", err)
+			}
+			filter.Before = t
+		default:
+			panic("unhandled option: -" + string(opt.Opt))
+		}
+		filtered = true
+	}
+
+	c, _ := initCache()
+
+	var entries []cache.Entry
+	for _, path := range opts.Args() {
+		e, err := c.Lookup(path)
+		if err != nil {
+			errExit("error: %s", err)
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) == 0 {
+		err := c.Walker(filter).Walk(func(entry cache.Entry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !filtered {
+				// list pinned logs
+				if entry.Pinned() {
+					fmt.Println(entry)
+				}
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			errExit("error: %s", err)
+		}
+		if !filtered {
+			return 0
+		}
+	}
+
+	var changed []cache.Entry
+	for _, e := range entries {
+		if e.Pinned() == pin {
+			continue
+		}
+		if pin {
+			fmt.Printf("Pinning %s\n", e)
+		} else {
+			fmt.Printf("Unpinning %s\n", e)
+		}
+		changed = append(changed, e)
+	}
+	// pins are saved once for all logs
+	if err := c.Pin(changed, pin); err != nil {
+		errExit("error: %s", err)
+	}
+
+	if pin {
+		fmt.Printf("Pinned %d log(s).\n", len(changed))
+	} else {
+		fmt.Printf("Unpinned %d log(s).\n", len(changed))
+	}
+
+	return 0
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dmgk/fallout/cache"
+	"github.com/dmgk/fallout/fetch"
+)
+
+// profile holds named cache profile settings.
+type profile struct {
+	// Profile name, empty for the default profile.
+	name string
+	// Cache directory.
+	cacheDir string
+	// Default fetch source URL.
+	fetchURL string
+	// Cache size quota enforced after each fetch, 0 if there's no quota.
+	quota int64
+	// Evict least recently used logs first when enforcing quota, instead of the oldest.
+	quotaLRU bool
+	// Number of days cleaned logs are kept in the trash, 0 if logs are removed immediately.
+	trashDays int
+}
+
+const (
+	profilesFileName   = "profiles"
+	defaultProfileName = "default"
+	defaultTrashDays   = 7
+)
+
+var (
+	profileName string
+	cacheDir    string
+)
+
+// profilesPath returns profiles configuration file path.
+func profilesPath() string {
+	root, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(root, progname, profilesFileName)
+}
+
+// loadProfile returns settings for the currently selected profile.
+// Profiles are read from the profiles file, which has the following format:
+//
+//	# comment
+//	[cluster]
+//	cache = ~/.cache/fallout
+//	url = https://lists.freebsd.org/archives/freebsd-pkg-fallout/
+//	quota = 2G
+//	evict = lru
+//	trash = 14
+//
+//	[our-poudriere]
+//	cache = ~/.cache/fallout-poudriere
+//	url = https://lists.example.org/archives/poudriere-fallout/
+//
+// Settings in the optional [default] section apply when no profile is selected.
+func loadProfile() (*profile, error) {
+	p := &profile{
+		name:      profileName,
+		fetchURL:  fetch.DefaultMaillistURL,
+		trashDays: defaultTrashDays,
+	}
+	if err := p.read(profilesPath()); err != nil {
+		return nil, err
+	}
+	// environment overrides profile settings
+	if v, ok := os.LookupEnv("FALLOUT_QUOTA"); ok && v != "" {
+		quota, err := parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("FALLOUT_QUOTA: %w", err)
+		}
+		p.quota = quota
+	}
+	return p, nil
+}
+
+// read reads profile settings from the profiles file at path.
+func (p *profile) read(path string) error {
+	section := p.name
+	if section == "" {
+		section = defaultProfileName
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if p.name == "" && os.IsNotExist(err) {
+			return nil // profiles file is optional for the default profile
+		}
+		return fmt.Errorf("unable to load profile %q: %w", p.name, err)
+	}
+	defer f.Close()
+
+	var current string
+	var found bool
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return fmt.Errorf("%s:%d: invalid section: %s", path, n, line)
+			}
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			if current == section {
+				found = true
+			}
+			continue
+		}
+		if current != section {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: invalid setting: %s", path, n, line)
+		}
+		switch k, v = strings.TrimSpace(k), strings.TrimSpace(v); k {
+		case "cache":
+			p.cacheDir = expandHome(v)
+		case "url":
+			p.fetchURL = v
+		case "quota":
+			if p.quota, err = parseSize(v); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		case "evict":
+			switch v {
+			case "oldest":
+				p.quotaLRU = false
+			case "lru":
+				p.quotaLRU = true
+			default:
+				return fmt.Errorf("%s:%d: invalid evict setting: %s", path, n, v)
+			}
+		case "trash":
+			if p.trashDays, err = strconv.Atoi(v); err != nil || p.trashDays < 0 {
+				return fmt.Errorf("%s:%d: invalid trash setting: %s", path, n, v)
+			}
+		default:
+			return fmt.Errorf("%s:%d: unknown setting: %s", path, n, k)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if !found && p.name != "" {
+		return fmt.Errorf("unknown profile %q", p.name)
+	}
+
+	return nil
+}
+
+// cachePath returns path of the log cache selected by the -d option,
+// FALLOUT_CACHE environment variable or the current profile, in that order.
+// FALLOUT_CACHE is ignored if the profile was selected with -P.
+func cachePath(p *profile) (string, error) {
+	if cacheDir != "" {
+		return expandHome(cacheDir), nil
+	}
+	if p.cacheDir != "" {
+		return p.cacheDir, nil
+	}
+	root, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	subdir := progname
+	if p.name != "" {
+		subdir += "-" + p.name
+	}
+	return filepath.Join(root, subdir), nil
+}
+
+// openCache opens the log cache selected for the profile p.
+func openCache(p *profile) (cache.Cacher, error) {
+	path, err := cachePath(p)
+	if err != nil {
+		return nil, err
+	}
+	return cache.NewDirectory(path, "")
+}
+
+// initCache opens the log cache for the currently selected profile or exits on error.
+func initCache() (cache.Cacher, *profile) {
+	p, err := loadProfile()
+	if err != nil {
+		errExit("error loading profile: %s", err)
+	}
+	c, err := openCache(p)
+	if err != nil {
+		var lerr *cache.LayoutError
+		if errors.As(err, &lerr) && lerr.Outdated() {
+			errExit("error initializing cache: %s\nrun \"%s cache migrate\" to upgrade it", err, progname)
+		}
+		errExit("error initializing cache: %s", err)
+	}
+	return c, p
+}
+
+// defaultCacheDir returns the default cache directory path.
+func defaultCacheDir() string {
+	root, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(root, progname)
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/dmgk/fallout/cache"
+)
+
+// cacheUsage returns cached contents size and the number of entries referencing
+// each content, by content ID. Trashed entries keep their contents on disk,
+// so they're counted too.
+func cacheUsage(c cache.Cacher) (int64, map[string]int, error) {
+	var total int64
+	refs := map[string]int{}
+
+	wfn := func(entry cache.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		st, err := entry.Stat()
+		if err != nil {
+			return err
+		}
+		if refs[st.ContentID]++; refs[st.ContentID] == 1 {
+			total += st.Size
+		}
+		return nil
+	}
+	if err := c.Walker(nil).Walk(wfn); err != nil {
+		return 0, nil, err
+	}
+	if err := c.Trash().Walker(time.Time{}, nil).Walk(wfn); err != nil {
+		return 0, nil, err
+	}
+	return total, refs, nil
+}
+
+// selectForQuota returns candidates that need to be removed for the cache
+// contents size to fit in quota, given the current total size and content references.
+// The oldest logs are evicted first, or the least recently used ones if lru is true.
+func selectForQuota(candidates []*cleanEntry, total int64, refs map[string]int, quota int64, lru bool) []*cleanEntry {
+	if total <= quota {
+		return nil
+	}
+
+	sorted := append([]*cleanEntry(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if lru {
+			return sorted[i].st.Used.Before(sorted[j].st.Used)
+		}
+		return sorted[i].info.Timestamp.Before(sorted[j].info.Timestamp)
+	})
+
+	var res []*cleanEntry
+	for _, ce := range sorted {
+		if total <= quota {
+			break
+		}
+		res = append(res, ce)
+		// contents are freed only when the last referencing entry is removed
+		if refs[ce.st.ContentID]--; refs[ce.st.ContentID] == 0 {
+			total -= ce.st.Size
+		}
+	}
+	return res
+}
+
+// evictToQuota removes cache entries until cached contents size fits in quota.
+// It returns the number of removed entries and freed bytes.
+func evictToQuota(c cache.Cacher, quota int64, lru bool) (int, int64, error) {
+	total, refs, err := cacheUsage(c)
+	if err != nil || total <= quota {
+		return 0, 0, err
+	}
+	entries, err := collectEntries(c, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	// pinned logs are never evicted
+	var candidates []*cleanEntry
+	for _, ce := range entries {
+		if !ce.pinned {
+			candidates = append(candidates, ce)
+		}
+	}
+
+	evict := selectForQuota(candidates, total, refs, quota, lru)
+	// quota limits disk usage, so evicted logs aren't kept in the trash
+	freed, err := removeEntries(c, evict, time.Time{}, false)
+	return len(evict), freed, err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/dmgk/fallout/cache"
+	"github.com/dmgk/getopt"
+)
+
+var restoreUsageTmpl = template.Must(template.New("usage-restore").Parse(`
+usage: {{.progname}} restore [-hlp] [-r run] [-b builder[,builder]] [-c category[,category]] [-o origin[,origin]] [-n name[,name]]
+
+Restore logs removed by clean from the trash.
+
+Options:
+  -h              show help and exit
+  -l              list clean runs that have logs in the trash, also --list
+  -p              only show what would be restored, also --dry-run
+  -r run          restore only logs removed by this clean run, as shown by -l, or "last" for the most recent one
+  -b builder,...  restore only logs from these builders
+  -c category,... restore only logs for these categories
+  -o origin,...   restore only logs for these origins, use origin@flavor for a single flavor
+  -n name,...     restore only logs for these port names
+                  values can be globs, e.g. -o 'devel/py-*', or regexps prefixed with ~, e.g. -b '~^main-.*-default$'
+                  prefix a value with ! to exclude it, e.g. -b '!i386'
+`[1:]))
+
+var restoreCmd = command{
+	Name:    "restore",
+	Summary: "restore cleaned logs from the trash",
+	run:     runRestore,
+}
+
+// -r value selecting the most recent clean run
+const lastRun = "last"
+
+var (
+	restoreList   bool
+	restoreDryRun bool
+	restoreRun    string
+)
+
+func showRestoreUsage() {
+	err := restoreUsageTmpl.Execute(os.Stdout, map[string]any{
+		"progname": progname,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("error executing template %s: %v", restoreUsageTmpl.Name(), err))
+	}
+}
+
+func runRestore(args []string) int {
+	const optstring = "hlpr:b:c:o:n:"
+	opts, err := getopt.NewArgv(optstring, expandLongOptions(args, optstring, map[string]byte{
+		"list":    'l',
+		"dry-run": 'p',
+	}))
+	if err != nil {
+		panic(fmt.Sprintf("error creating options parser: %s", err))
+	}
+
+	for opts.Scan() {
+		opt, err := opts.Option()
+		if err != nil {
+			errExit(err.Error())
+		}
+
+		switch opt.Opt {
+		case 'h':
+			showRestoreUsage()
+			os.Exit(0)
+		case 'l':
+			restoreList = true
+		case 'p':
+			restoreDryRun = true
+		case 'r':
+			restoreRun = opt.String()
+		case 'b':
+			builders = splitOptions(opt.String())
+		case 'c':
+			categories = splitOptions(opt.String())
+		case 'o':
+			origins = splitOptions(opt.String())
+		case 'n':
+			names = splitOptions(opt.String())
+		default:
+			panic("unhandled option: -" + string(opt.Opt))
+		}
+	}
+
+	c, _ := initCache()
+	trash := c.Trash()
+
+	runs, err := trash.Runs()
+	if err != nil {
+		errExit("error: %s", err)
+	}
+	if len(runs) == 0 {
+		fmt.Println("Trash is empty.")
+		return 0
+	}
+
+	if restoreList {
+		for _, r := range runs {
+			count, size, err := trashUsage(trash, r)
+			if err != nil {
+				errExit("error: %s", err)
+			}
+			fmt.Printf("%s : %d log(s), %s\n", r.Format(cache.RunFormat), count, formatSize(size))
+		}
+		return 0
+	}
+
+	var run time.Time
+	switch restoreRun {
+	case "":
+	case lastRun:
+		run = runs[len(runs)-1]
+	default:
+		if run, err = parseDateTime(restoreRun); err != nil {
+			errExit("-r: %s", err)
+		}
+	}
+
+	var restored, skipped int
+	w := trash.Walker(run, &cache.Filter{
+		Builders:   builders,
+		Categories: categories,
+		Origins:    origins,
+		Names:      names,
+	})
+	err = w.Walk(func(entry cache.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		if restoreDryRun {
+			fmt.Printf("Would restore %s\n", entry)
+			restored++
+			return nil
+		}
+		if err := trash.Restore(entry); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				// the same log was downloaded again after clean
+				fmt.Printf("Skipping %s (cached)\n", entry)
+				skipped++
+				return nil
+			}
+			return err
+		}
+		fmt.Printf("Restoring %s\n", entry)
+		restored++
+		return nil
+	})
+	if err != nil {
+		errExit("error: %s", err)
+	}
+
+	switch {
+	case restored == 0 && skipped == 0:
+		fmt.Println("Nothing to restore.")
+	case restoreDryRun:
+		fmt.Printf("Would restore %d log(s).\n", restored)
+	default:
+		fmt.Printf("Restored %d log(s), skipped %d.\n", restored, skipped)
+	}
+
+	return 0
+}
+
+// trashUsage returns the number and contents size of logs trashed by run.
+func trashUsage(trash cache.Trash, run time.Time) (int, int64, error) {
+	var count int
+	var size int64
+	err := trash.Walker(run, nil).Walk(func(entry cache.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		st, err := entry.Stat()
+		if err != nil {
+			return err
+		}
+		count++
+		size += st.Size
+		return nil
+	})
+	return count, size, err
+}
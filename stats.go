@@ -11,12 +11,20 @@ import (
 )
 
 var statsUsageTmpl = template.Must(template.New("usage-stats").Parse(`
-usage: {{.progname}} stats [-h]
+usage: {{.progname}} stats [-htT] [-b builder[,builder]] [-c category[,category]] [-o origin[,origin]] [-n name[,name]]
 
 Show cached logs statistics.
 
 Options:
   -h              show help and exit
+  -t              count only the latest log for each builder and origin, also --latest
+  -T              count only the latest log for each origin across all builders, also --latest-origin
+  -b builder,...  count only logs from these builders
+  -c category,... count only logs for these categories
+  -o origin,...   count only logs for these origins, use origin@flavor for a single flavor
+  -n name,...     count only logs for these port names
+                  values can be globs, e.g. -o 'devel/py-*', or regexps prefixed with ~, e.g. -b '~^main-.*-default$'
+                  prefix a value with ! to exclude it, e.g. -b '!i386'
 `[1:]))
 
 var statsCmd = command{
@@ -26,7 +34,9 @@ var statsCmd = command{
 }
 
 func showStatsUsage() {
-	err := statsUsageTmpl.Execute(os.Stdout, map[string]any{})
+	err := statsUsageTmpl.Execute(os.Stdout, map[string]any{
+		"progname": progname,
+	})
 	if err != nil {
 		panic(fmt.Sprintf("error executing template %s: %v", statsUsageTmpl.Name(), err))
 	}
@@ -34,6 +44,7 @@ func showStatsUsage() {
 
 var statsTmpl = template.Must(template.New("stats-output").Parse(`
 Cache size:    {{.logsSize}}
+Dedup savings: {{.dedupSize}} ({{.dedupCount}} duplicate logs)
 Latest log:    {{.latestTimestamp}}
 Oldest log:    {{.earliestTimestamp}}
 Builders:      {{.buildersCount}}
@@ -42,8 +53,14 @@ Logs:          {{.logsCount}}
 Most failures: {{.topBuilderName}} ({{.topBuilderCount}} ports)
 `[1:]))
 
+var statsLatest cache.Latest
+
 func runStats(args []string) int {
-	opts, err := getopt.NewArgv("h", args)
+	const optstring = "htTb:c:o:n:"
+	opts, err := getopt.NewArgv(optstring, expandLongOptions(args, optstring, map[string]byte{
+		"latest":        't',
+		"latest-origin": 'T',
+	}))
 	if err != nil {
 		panic(fmt.Sprintf("error creating options parser: %s", err))
 	}
@@ -58,6 +75,18 @@ func runStats(args []string) int {
 		case 'h':
 			showStatsUsage()
 			os.Exit(0)
+		case 't':
+			statsLatest = cache.LatestPerBuilder
+		case 'T':
+			statsLatest = cache.LatestPerOrigin
+		case 'b':
+			builders = splitOptions(opt.String())
+		case 'c':
+			categories = splitOptions(opt.String())
+		case 'o':
+			origins = splitOptions(opt.String())
+		case 'n':
+			names = splitOptions(opt.String())
 		default:
 			panic("unhandled option: -" + string(opt.Opt))
 		}
@@ -71,16 +100,21 @@ func runStats(args []string) int {
 		originsSet      = map[string]struct{}{}
 		logTotalCount   int
 		logTotalSize    int64
+		contentSet      = map[string]struct{}{}
+		contentSize     int64
 		topBuilderName  string
 		topBuilderCount int
 	)
 
-	c, err := cache.NewDefaultDirectory(progname)
-	if err != nil {
-		errExit("error initializing cache: %s", err)
-	}
+	c, _ := initCache()
 
-	w := c.Walker(nil)
+	w := c.Walker(&cache.Filter{
+		Builders:   builders,
+		Categories: categories,
+		Origins:    origins,
+		Names:      names,
+		Latest:     statsLatest,
+	})
 	err = w.Walk(func(entry cache.Entry, err error) error {
 		if err != nil {
 			return err
@@ -101,16 +135,15 @@ func runStats(args []string) int {
 		originsSet[inf.Origin] = struct{}{}
 		logTotalCount += 1
 
-		f, err := os.Open(entry.Path())
+		st, err := entry.Stat()
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		fi, err := f.Stat()
-		if err != nil {
-			return err
+		logTotalSize += st.Size
+		if _, ok := contentSet[st.ContentID]; !ok {
+			contentSet[st.ContentID] = struct{}{}
+			contentSize += st.Size
 		}
-		logTotalSize += fi.Size()
 
 		return nil
 	})
@@ -138,7 +171,9 @@ func runStats(args []string) int {
 		"topBuilderCount":   topBuilderCount,
 		"originsCount":      len(originsSet),
 		"logsCount":         logTotalCount,
-		"logsSize":          formatSize(logTotalSize),
+		"logsSize":          formatSize(contentSize),
+		"dedupSize":         formatSize(logTotalSize - contentSize),
+		"dedupCount":        logTotalCount - len(contentSet),
 	})
 	if err != nil {
 		errExit("error: %s", err)